@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	accessLogCombined = "combined"
+	accessLogJson     = "json"
+	accessLogTemplate = "template"
+)
+
+type ctxKey int
+
+const accessLogKey ctxKey = 0
+
+type accessLogEntry struct {
+	Time         time.Time     `json:"time"`
+	RemoteAddr   string        `json:"remote_addr"`
+	Host         string        `json:"host"`
+	Method       string        `json:"method"`
+	URI          string        `json:"uri"`
+	Proto        string        `json:"proto"`
+	Status       int           `json:"status"`
+	Bytes        int64         `json:"bytes"`
+	Duration     time.Duration `json:"duration_ns"`
+	Referer      string        `json:"referer"`
+	UserAgent    string        `json:"user_agent"`
+	Upstream     string        `json:"upstream,omitempty"`
+	UpstreamAddr string        `json:"upstream_addr,omitempty"`
+}
+
+func setUpstream(req *http.Request, name, addr string) {
+	if entry, ok := req.Context().Value(accessLogKey).(*accessLogEntry); ok {
+		entry.Upstream = name
+		entry.UpstreamAddr = addr
+	}
+}
+
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		if w.status == 0 {
+			w.status = http.StatusSwitchingProtocols
+		}
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("http.Hijacker not supported")
+}
+
+type accessLogFile struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+	refs int
+}
+
+func (f *accessLogFile) open() (err error) {
+	if f.path == "-" || f.path == "stdout" {
+		f.file = os.Stdout
+		return
+	}
+	f.file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	return
+}
+
+func (f *accessLogFile) Reopen() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == os.Stdout {
+		return
+	}
+	old := f.file
+	if err := f.open(); err != nil {
+		log.Printf("Access log reopen error: file=%s err=%v", f.path, err)
+		f.file = old
+		return
+	}
+	if old != nil {
+		old.Close()
+	}
+}
+
+func (f *accessLogFile) Write(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Write(b)
+	}
+}
+
+var accessLogFiles = struct {
+	sync.Mutex
+	m map[string]*accessLogFile
+}{m: make(map[string]*accessLogFile)}
+
+func acquireAccessLogFile(path string) (f *accessLogFile, err error) {
+	accessLogFiles.Lock()
+	defer accessLogFiles.Unlock()
+	if f = accessLogFiles.m[path]; f == nil {
+		f = &accessLogFile{path: path}
+		if err = f.open(); err != nil {
+			return nil, err
+		}
+		accessLogFiles.m[path] = f
+	}
+	f.refs++
+	return
+}
+
+func releaseAccessLogFile(f *accessLogFile) {
+	accessLogFiles.Lock()
+	defer accessLogFiles.Unlock()
+	f.refs--
+	if f.refs <= 0 {
+		delete(accessLogFiles.m, f.path)
+		f.mu.Lock()
+		if f.file != nil && f.file != os.Stdout {
+			f.file.Close()
+		}
+		f.file = nil
+		f.mu.Unlock()
+	}
+}
+
+func reopenAccessLogs() {
+	accessLogFiles.Lock()
+	defer accessLogFiles.Unlock()
+	for _, f := range accessLogFiles.m {
+		f.Reopen()
+	}
+	log.Println("Access logs reopened")
+}
+
+type accessLogger struct {
+	format string
+	tmpl   *template.Template
+	out    *accessLogFile
+}
+
+func (logger *accessLogger) Log(entry *accessLogEntry) {
+	var buf bytes.Buffer
+	switch logger.format {
+	case accessLogJson:
+		json.NewEncoder(&buf).Encode(entry)
+	case accessLogTemplate:
+		if err := logger.tmpl.Execute(&buf, entry); err != nil {
+			log.Printf("Access log template error: %v", err)
+			return
+		}
+		if b := buf.Bytes(); len(b) == 0 || b[len(b)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	default:
+		host := entry.RemoteAddr
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		bytesSent := "-"
+		if entry.Bytes > 0 {
+			bytesSent = fmt.Sprintf("%d", entry.Bytes)
+		}
+		fmt.Fprintf(&buf, "%s - - [%s] \"%s %s %s\" %d %s %q %q\n", host, entry.Time.Format("02/Jan/2006:15:04:05 -0700"), entry.Method, entry.URI, entry.Proto, entry.Status, bytesSent, entry.Referer, entry.UserAgent)
+	}
+	logger.out.Write(buf.Bytes())
+}
+
+func (logger *accessLogger) Close() {
+	releaseAccessLogFile(logger.out)
+}
+
+func newAccessLogTemplate(text string) (tmpl *template.Template, err error) {
+	if tmpl, err = template.New("access_log").Parse(text); err != nil {
+		err = fmt.Errorf("access log template: %v", err)
+	}
+	return
+}
+
+func newAccessLogger(cfg *cfgAccessLog) (logger *accessLogger, err error) {
+	logger = &accessLogger{format: cfg.Format}
+	switch cfg.Format {
+	case "", accessLogCombined:
+		logger.format = accessLogCombined
+	case accessLogJson:
+	case accessLogTemplate:
+		if logger.tmpl, err = newAccessLogTemplate(cfg.Template); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown access log format: %s", cfg.Format)
+	}
+	if logger.out, err = acquireAccessLogFile(cfg.File); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func serveObserved(logger *accessLogger, site *cfgSite, laddr string, h http.Handler, rw http.ResponseWriter, req *http.Request) {
+	entry := &accessLogEntry{
+		Time:       time.Now(),
+		RemoteAddr: req.RemoteAddr,
+		Host:       req.Host,
+		Method:     req.Method,
+		URI:        req.RequestURI,
+		Proto:      req.Proto,
+		Referer:    req.Referer(),
+		UserAgent:  req.UserAgent(),
+	}
+	w := &accessLogWriter{ResponseWriter: rw}
+	req = req.WithContext(context.WithValue(req.Context(), accessLogKey, entry))
+	defer func() {
+		entry.Duration = time.Since(entry.Time)
+		entry.Status = w.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Bytes = w.bytes
+		siteHost := ""
+		if site != nil {
+			siteHost = site.Host
+		}
+		stats.ObserveRequest(siteHost, laddr, entry)
+		if logger != nil {
+			logger.Log(entry)
+		}
+	}()
+	h.ServeHTTP(w, req)
+}
+
+func stripHostPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(host, ".")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	acmeChallengePath    = "/.well-known/acme-challenge/"
+	defaultAcmeDirectory = autocert.DefaultACMEDirectory
+)
+
+// acmeManager is an autocert.Manager that only obtains certificates for
+// the ssl_acme hosts of the current configuration.
+type acmeManager struct {
+	*autocert.Manager
+	hosts atomic.Value
+}
+
+func (mgr *acmeManager) hostPolicy(ctx context.Context, host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if !mgr.hosts.Load().(map[string]bool)[strings.ToLower(host)] {
+		return fmt.Errorf("acme: host %q is not an ssl_acme site", host)
+	}
+	return nil
+}
+
+var acmeManagers = struct {
+	sync.Mutex
+	m map[cfgAcmeOpts]*acmeManager
+}{m: make(map[cfgAcmeOpts]*acmeManager)}
+
+// getAcmeManager shares managers between configuration generations so a
+// reload does not request certificates that are already being obtained
+// or renewed.
+func getAcmeManager(cfg *cfgAcmeOpts) (*acmeManager, error) {
+	acmeManagers.Lock()
+	defer acmeManagers.Unlock()
+	if mgr, ok := acmeManagers.m[*cfg]; ok {
+		return mgr, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CaCert != "" {
+		pem, err := ioutil.ReadFile(cfg.CaCert)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("acme ca_cert: no certificates found")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	client := &acme.Client{
+		DirectoryURL: cfg.DirectoryUrl,
+		HTTPClient:   &http.Client{Transport: transport},
+	}
+	if cfg.DirectoryUrl != defaultAcmeDirectory {
+		client.HTTPClient.Transport = &acmeTransport{next: transport, orders: make(map[string]string)}
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+	mgr := &acmeManager{Manager: &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cfg.Dir),
+		Email:       cfg.Email,
+		RenewBefore: cfg.RenewBefore,
+		Client:      client,
+	}}
+	mgr.hosts.Store(map[string]bool{})
+	mgr.HostPolicy = mgr.hostPolicy
+	// Plain listeners answer HTTP-01; asking for the handler now lets the
+	// manager fall back to it when TLS-ALPN-01 fails.
+	mgr.HTTPHandler(nil)
+	log.Printf("Starting ACME: directory_url=%s dir=%s", cfg.DirectoryUrl, cfg.Dir)
+	acmeManagers.m[*cfg] = mgr
+	return mgr, nil
+}
+
+// setAcmeHosts limits the ACME manager of gen to the hosts of its
+// ssl_acme sites.
+func setAcmeHosts(gen *generation) {
+	if gen.acme == nil {
+		return
+	}
+	hosts := make(map[string]bool)
+	for _, certs := range gen.certs {
+		for host := range certs.acmeHosts {
+			hosts[host] = true
+		}
+	}
+	gen.acme.hosts.Store(hosts)
+}
+
+// maxAcmeOrders bounds the orders acmeTransport remembers between their
+// creation and finalization.
+const maxAcmeOrders = 64
+
+// acmeTransport adds the order URL as Location to finalize responses that
+// lack it. The acme client polls an order that is still processing through
+// that header, which RFC 8555 does not require and some servers (Pebble)
+// leave out. It is only used with a directory_url other than the default,
+// since Let's Encrypt always sends it.
+type acmeTransport struct {
+	next   http.RoundTripper
+	mu     sync.Mutex
+	orders map[string]string
+}
+
+func (t *acmeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost || res.StatusCode >= 300 {
+		return res, err
+	}
+	reqUrl := req.URL.String()
+	loc := res.Header.Get("Location")
+	t.mu.Lock()
+	order, isFinalize := t.orders[reqUrl]
+	delete(t.orders, reqUrl)
+	t.mu.Unlock()
+	if isFinalize {
+		if loc == "" {
+			res.Header.Set("Location", order)
+		}
+		return res, nil
+	}
+	if loc == "" || !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		return res, nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var v struct {
+		Finalize string `json:"finalize"`
+	}
+	if json.Unmarshal(body, &v) == nil && v.Finalize != "" {
+		t.mu.Lock()
+		if len(t.orders) >= maxAcmeOrders {
+			for finalize := range t.orders {
+				delete(t.orders, finalize)
+				break
+			}
+		}
+		t.orders[v.Finalize] = loc
+		t.mu.Unlock()
+	}
+	return res, nil
+}
+
+// serveAcmeChallenge answers HTTP-01 challenges for ssl_acme hosts on
+// plain listeners.
+func serveAcmeChallenge(gen *generation, rw http.ResponseWriter, req *http.Request) bool {
+	if gen.acme == nil || req.TLS != nil || !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		return false
+	}
+	if gen.acme.hostPolicy(req.Context(), req.Host) != nil {
+		return false
+	}
+	gen.acme.HTTPHandler(nil).ServeHTTP(rw, req)
+	return true
+}
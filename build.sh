@@ -12,5 +12,5 @@ fi
 
 BUILDDATE=`date +%Y-%m-%d\ %H:%M`
 
-go get github.com/mitchellh/gox
+go install github.com/mitchellh/gox@latest
 gox -os="darwin linux windows" -arch="386 amd64" -ldflags "-X main.majversion=$MAJVER -X main.minversion=$MINVER -X \"main.builddate=$BUILDDATE\"" -output="build/${MAJVER}.${MINVER}/gosimpleweb-${MAJVER}.${MINVER}-{{.OS}}-{{.Arch}}"
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type cacheStore interface {
+	Get(key string) (*cacheEntry, bool)
+	Set(key string, entry *cacheEntry)
+	Delete(key string) bool
+	SetMaxSize(size int64)
+	Size() (entries int, bytes int64)
+}
+
+type cacheLRUItem struct {
+	key   string
+	size  int64
+	entry *cacheEntry
+}
+
+// cacheLRU keeps the least recently used items at the back and evicts
+// them once the total size goes over max.
+type cacheLRU struct {
+	max   int64
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+	evict func(item *cacheLRUItem)
+}
+
+func (lru *cacheLRU) Get(key string) (*cacheLRUItem, bool) {
+	el, ok := lru.items[key]
+	if !ok {
+		return nil, false
+	}
+	lru.ll.MoveToFront(el)
+	return el.Value.(*cacheLRUItem), true
+}
+
+func (lru *cacheLRU) Add(item *cacheLRUItem) {
+	if el, ok := lru.items[item.key]; ok {
+		lru.size -= el.Value.(*cacheLRUItem).size
+		el.Value = item
+		lru.ll.MoveToFront(el)
+	} else {
+		lru.items[item.key] = lru.ll.PushFront(item)
+	}
+	lru.size += item.size
+	lru.trim()
+}
+
+func (lru *cacheLRU) Remove(key string) bool {
+	el, ok := lru.items[key]
+	if !ok {
+		return false
+	}
+	lru.remove(el)
+	return true
+}
+
+func (lru *cacheLRU) remove(el *list.Element) {
+	item := el.Value.(*cacheLRUItem)
+	lru.ll.Remove(el)
+	delete(lru.items, item.key)
+	lru.size -= item.size
+	if lru.evict != nil {
+		lru.evict(item)
+	}
+}
+
+func (lru *cacheLRU) trim() {
+	for lru.size > lru.max && lru.ll.Len() > 0 {
+		lru.remove(lru.ll.Back())
+	}
+}
+
+func newCacheLRU(max int64, evict func(item *cacheLRUItem)) *cacheLRU {
+	return &cacheLRU{max: max, ll: list.New(), items: make(map[string]*list.Element), evict: evict}
+}
+
+type memoryCacheStore struct {
+	mu  sync.Mutex
+	lru *cacheLRU
+}
+
+func (store *memoryCacheStore) Get(key string) (*cacheEntry, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if item, ok := store.lru.Get(key); ok {
+		return item.entry, true
+	}
+	return nil, false
+}
+
+func (store *memoryCacheStore) Set(key string, entry *cacheEntry) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.lru.Add(&cacheLRUItem{key: key, size: entry.Size(), entry: entry})
+}
+
+func (store *memoryCacheStore) Delete(key string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.lru.Remove(key)
+}
+
+func (store *memoryCacheStore) SetMaxSize(size int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.lru.max = size
+	store.lru.trim()
+}
+
+func (store *memoryCacheStore) Size() (int, int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.lru.ll.Len(), store.lru.size
+}
+
+func newMemoryCacheStore(cfg *cfgCacheOpts) *memoryCacheStore {
+	return &memoryCacheStore{lru: newCacheLRU(cfg.MaxSize, nil)}
+}
+
+// diskCacheStore keeps one gob encoded file per entry in dir and only
+// the keys and sizes in memory.
+type diskCacheStore struct {
+	dir string
+	mu  sync.Mutex
+	lru *cacheLRU
+}
+
+func (store *diskCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(store.dir, hex.EncodeToString(sum[:])+".cache")
+}
+
+func (store *diskCacheStore) read(name string) (*cacheEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entry := new(cacheEntry)
+	if err = gob.NewDecoder(f).Decode(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (store *diskCacheStore) Get(key string) (*cacheEntry, bool) {
+	store.mu.Lock()
+	_, ok := store.lru.Get(key)
+	store.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	entry, err := store.read(store.path(key))
+	if err != nil || entry.Key != key {
+		store.Delete(key)
+		return nil, false
+	}
+	return entry, true
+}
+
+func (store *diskCacheStore) Set(key string, entry *cacheEntry) {
+	f, err := ioutil.TempFile(store.dir, ".tmp-")
+	if err != nil {
+		log.Printf("Cache write error: dir=%s err=%v", store.dir, err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(entry)
+	fi, _ := f.Stat()
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), store.path(key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Printf("Cache write error: dir=%s err=%v", store.dir, err)
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.lru.Add(&cacheLRUItem{key: key, size: fi.Size()})
+}
+
+func (store *diskCacheStore) Delete(key string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.lru.Remove(key)
+}
+
+func (store *diskCacheStore) SetMaxSize(size int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.lru.max = size
+	store.lru.trim()
+}
+
+func (store *diskCacheStore) Size() (int, int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.lru.ll.Len(), store.lru.size
+}
+
+// load indexes the entries left in dir by an earlier run, oldest first so
+// they are evicted first.
+func (store *diskCacheStore) load() error {
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, fi := range files {
+		name := filepath.Join(store.dir, fi.Name())
+		if strings.HasPrefix(fi.Name(), ".tmp-") {
+			os.Remove(name)
+			continue
+		}
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".cache") {
+			continue
+		}
+		entry, err := store.read(name)
+		if err != nil || store.path(entry.Key) != name {
+			os.Remove(name)
+			continue
+		}
+		store.lru.Add(&cacheLRUItem{key: entry.Key, size: fi.Size()})
+	}
+	return nil
+}
+
+func newDiskCacheStore(cfg *cfgCacheOpts) (store *diskCacheStore, err error) {
+	store = &diskCacheStore{dir: cfg.Dir}
+	store.lru = newCacheLRU(cfg.MaxSize, func(item *cacheLRUItem) {
+		os.Remove(store.path(item.key))
+	})
+	if err = os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+	if err = store.load(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+type cacheStoreRef struct {
+	id    string
+	store cacheStore
+	refs  int
+}
+
+var cacheStores = struct {
+	sync.Mutex
+	m map[string]*cacheStoreRef
+}{m: make(map[string]*cacheStoreRef)}
+
+// acquireCacheStore shares stores between configuration generations so a
+// reload keeps what has been cached so far.
+func acquireCacheStore(name string, cfg *cfgCacheOpts) (ref *cacheStoreRef, err error) {
+	id := cacheMemory + ":" + name
+	if cfg.Store == cacheDisk {
+		dir, _ := filepath.Abs(cfg.Dir)
+		id = cacheDisk + ":" + dir
+	}
+	cacheStores.Lock()
+	defer cacheStores.Unlock()
+	if ref = cacheStores.m[id]; ref == nil {
+		ref = &cacheStoreRef{id: id}
+		if cfg.Store == cacheDisk {
+			if ref.store, err = newDiskCacheStore(cfg); err != nil {
+				return nil, err
+			}
+		} else {
+			ref.store = newMemoryCacheStore(cfg)
+		}
+		cacheStores.m[id] = ref
+	} else {
+		ref.store.SetMaxSize(cfg.MaxSize)
+	}
+	ref.refs++
+	return
+}
+
+func releaseCacheStore(ref *cacheStoreRef) {
+	cacheStores.Lock()
+	defer cacheStores.Unlock()
+	ref.refs--
+	if ref.refs <= 0 {
+		delete(cacheStores.m, ref.id)
+	}
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cacheMemory = "memory"
+	cacheDisk   = "disk"
+)
+
+var cacheStoreTypes = []string{cacheMemory, cacheDisk}
+
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"X-Cache",
+}
+
+var cacheKeyVar = regexp.MustCompile(`\$([A-Za-z0-9_]+)`)
+
+// cacheEntry is a stored response. Entries with a zero Status only record
+// the Vary header names of the responses stored for their key and the keys
+// of those variants.
+type cacheEntry struct {
+	Key            string
+	Status         int
+	Header         http.Header
+	Body           []byte
+	Vary           []string
+	Variants       []string
+	Stored         time.Time
+	Expires        time.Time
+	Swr            time.Duration
+	Sie            time.Duration
+	MustRevalidate bool
+	NoCache        bool
+}
+
+func (entry *cacheEntry) Size() int64 {
+	size := int64(len(entry.Key) + len(entry.Body) + 128)
+	for _, key := range entry.Variants {
+		size += int64(len(key))
+	}
+	for k, v := range entry.Header {
+		size += int64(len(k))
+		for _, v2 := range v {
+			size += int64(len(v2))
+		}
+	}
+	return size
+}
+
+func (entry *cacheEntry) Fresh(now time.Time) bool {
+	return !entry.NoCache && now.Before(entry.Expires)
+}
+
+func (entry *cacheEntry) Usable(now time.Time, stale time.Duration) bool {
+	return !entry.MustRevalidate && !entry.NoCache && now.Before(entry.Expires.Add(stale))
+}
+
+// Validators tells whether the entry can be revalidated with a conditional
+// request.
+func (entry *cacheEntry) Validators() bool {
+	return entry.Header.Get("ETag") != "" || entry.Header.Get("Last-Modified") != ""
+}
+
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value := part, ""
+			if i := strings.Index(part, "="); i >= 0 {
+				name, value = part[:i], strings.Trim(part[i+1:], "\"")
+			}
+			directives[strings.ToLower(name)] = value
+		}
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	v, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+type cacheZone struct {
+	name     string
+	cfg      *cfgCacheOpts
+	ref      *cacheStoreRef
+	store    cacheStore
+	allow    []*net.IPNet
+	mu       sync.Mutex
+	updating map[string]bool
+}
+
+func (zone *cacheZone) key(req *http.Request) string {
+	return cacheKeyVar.ReplaceAllStringFunc(zone.cfg.Key, func(m string) string {
+		name := m[1:]
+		switch {
+		case name == "scheme":
+			if req.TLS != nil {
+				return "https"
+			}
+			return "http"
+		case name == "host":
+			return strings.ToLower(stripHostPort(req.Host))
+		case name == "method":
+			return req.Method
+		case name == "uri":
+			return req.URL.Path
+		case name == "query":
+			return req.URL.RawQuery
+		case name == "request_uri":
+			return req.URL.RequestURI()
+		case strings.HasPrefix(name, "cookie_"):
+			if c, err := req.Cookie(name[7:]); err == nil {
+				return c.Value
+			}
+			return ""
+		case strings.HasPrefix(name, "http_"):
+			return req.Header.Get(strings.Replace(name[5:], "_", "-", -1))
+		}
+		return m
+	})
+}
+
+func varyKey(primary string, marker *cacheEntry, h http.Header) string {
+	key := primary + "\x00" + strconv.FormatInt(marker.Stored.UnixNano(), 36)
+	for _, name := range marker.Vary {
+		key += "\x00" + strings.Join(h.Values(name), ",")
+	}
+	return key
+}
+
+func (zone *cacheZone) lookup(primary string, req *http.Request) *cacheEntry {
+	entry, ok := zone.store.Get(primary)
+	if !ok {
+		return nil
+	}
+	if entry.Status == 0 {
+		if entry, ok = zone.store.Get(varyKey(primary, entry, req.Header)); !ok {
+			return nil
+		}
+	}
+	return entry
+}
+
+func (zone *cacheZone) save(primary string, req *http.Request, entry *cacheEntry) {
+	if len(entry.Vary) == 0 {
+		entry.Key = primary
+		zone.store.Set(primary, entry)
+		return
+	}
+	zone.mu.Lock()
+	defer zone.mu.Unlock()
+	marker, ok := zone.store.Get(primary)
+	if !ok || marker.Status != 0 || strings.Join(marker.Vary, ",") != strings.Join(entry.Vary, ",") {
+		if ok {
+			zone.remove(marker)
+		}
+		marker = &cacheEntry{Key: primary, Vary: entry.Vary, Stored: entry.Stored}
+	}
+	entry.Key = varyKey(primary, marker, req.Header)
+	zone.store.Set(entry.Key, entry)
+	for _, key := range marker.Variants {
+		if key == entry.Key {
+			return
+		}
+	}
+	updated := *marker
+	updated.Variants = append(append([]string(nil), marker.Variants...), entry.Key)
+	zone.store.Set(primary, &updated)
+}
+
+// remove deletes an entry together with the variants its marker lists.
+func (zone *cacheZone) remove(entry *cacheEntry) bool {
+	for _, key := range entry.Variants {
+		zone.store.Delete(key)
+	}
+	return zone.store.Delete(entry.Key)
+}
+
+// newEntry decides whether a response may be stored and for how long,
+// following its Cache-Control, Expires and Vary headers. Responses marked
+// no-cache are only stored when they can be revalidated.
+func (zone *cacheZone) newEntry(req *http.Request, status int, header http.Header, body []byte) (*cacheEntry, bool) {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" {
+		return nil, false
+	}
+	cc := cacheControl(header)
+	for _, name := range []string{"no-store", "private"} {
+		if _, ok := cc[name]; ok {
+			return nil, false
+		}
+	}
+	_, noCache := cc["no-cache"]
+	if noCache && header.Get("ETag") == "" && header.Get("Last-Modified") == "" {
+		return nil, false
+	}
+	_, public := cc["public"]
+	_, shared := cc["s-maxage"]
+	if req.Header.Get("Authorization") != "" && !public && !shared {
+		return nil, false
+	}
+	var vary []string
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return nil, false
+			} else if name != "" {
+				vary = append(vary, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	now := time.Now()
+	ttl, ok := directiveSeconds(cc, "s-maxage")
+	if !ok {
+		ttl, ok = directiveSeconds(cc, "max-age")
+	}
+	if !ok && header.Get("Expires") != "" {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+			ttl, ok = expires.Sub(date), true
+		} else {
+			ttl, ok = 0, true
+		}
+	}
+	if !ok {
+		ttl = zone.cfg.DefaultTtl
+	}
+	stored := now
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		stored = now.Add(-time.Duration(age) * time.Second)
+	}
+	if !noCache && !stored.Add(ttl).After(now) {
+		return nil, false
+	}
+	entry := &cacheEntry{
+		Status:  status,
+		Header:  header.Clone(),
+		Body:    body,
+		Vary:    vary,
+		Stored:  stored,
+		Expires: stored.Add(ttl),
+		Swr:     zone.cfg.StaleWhileRevalidate,
+		Sie:     zone.cfg.StaleIfError,
+	}
+	if d, ok := directiveSeconds(cc, "stale-while-revalidate"); ok {
+		entry.Swr = d
+	}
+	if d, ok := directiveSeconds(cc, "stale-if-error"); ok {
+		entry.Sie = d
+	}
+	_, mustRevalidate := cc["must-revalidate"]
+	_, proxyRevalidate := cc["proxy-revalidate"]
+	entry.MustRevalidate = mustRevalidate || proxyRevalidate
+	entry.NoCache = noCache
+	for _, name := range hopHeaders {
+		entry.Header.Del(name)
+	}
+	entry.Header.Del("Age")
+	return entry, true
+}
+
+func notModified(req *http.Request, entry *cacheEntry) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(entry.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil {
+		if lm, err := http.ParseTime(entry.Header.Get("Last-Modified")); err == nil {
+			return !lm.After(ims)
+		}
+	}
+	return false
+}
+
+func (zone *cacheZone) count(result string) {
+	stats.Add("gosimpleweb_cache_requests_total", "Cache lookups per cache and result.", metricLabels("cache", zone.name, "result", result), 1)
+}
+
+func (zone *cacheZone) serve(rw http.ResponseWriter, req *http.Request, entry *cacheEntry, result string) {
+	zone.count(result)
+	h := rw.Header()
+	for k, v := range entry.Header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+	h.Set("X-Cache", strings.ToUpper(result))
+	if notModified(req, entry) {
+		h.Del("Content-Length")
+		h.Del("Content-Type")
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	rw.WriteHeader(entry.Status)
+	if req.Method != http.MethodHead {
+		rw.Write(entry.Body)
+	}
+}
+
+func (zone *cacheZone) purge(rw http.ResponseWriter, req *http.Request) {
+	ip := net.ParseIP(stripHostPort(req.RemoteAddr))
+	allowed := false
+	for _, ipNet := range zone.allow {
+		if ip != nil && ipNet.Contains(ip) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("403: Forbidden"))
+		return
+	}
+	keyReq := req.WithContext(req.Context())
+	keyReq.Method = http.MethodGet
+	entry, ok := zone.store.Get(zone.key(keyReq))
+	zone.mu.Lock()
+	purged := ok && zone.remove(entry)
+	zone.mu.Unlock()
+	if purged {
+		zone.count("purge")
+		rw.Write([]byte("200: Purged"))
+	} else {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("404: Not Cached"))
+	}
+}
+
+func (zone *cacheZone) Close() {
+	releaseCacheStore(zone.ref)
+}
+
+func parseCidrs(list []string) (nets []*net.IPNet, err error) {
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+func newCacheZone(name string, cfg *cfgCacheOpts) (zone *cacheZone, err error) {
+	zone = &cacheZone{name: name, cfg: cfg, updating: make(map[string]bool)}
+	if zone.allow, err = parseCidrs(cfg.PurgeAllow); err != nil {
+		return nil, fmt.Errorf("cache %s: %v", name, err)
+	}
+	if zone.ref, err = acquireCacheStore(name, cfg); err != nil {
+		return nil, fmt.Errorf("cache %s: %v", name, err)
+	}
+	zone.store = zone.ref.store
+	return
+}
+
+// cacheWriter passes a response through while keeping a copy of its body,
+// unless the upstream failed and a stale entry can be served instead, or
+// it confirmed the validated entry with 304 Not Modified.
+type cacheWriter struct {
+	http.ResponseWriter
+	stale       *cacheEntry
+	useStale    bool
+	validated   *cacheEntry
+	notModified bool
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	limit       int64
+	capture     bool
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	if status == http.StatusNotModified && w.validated != nil {
+		w.header = w.Header().Clone()
+		w.notModified = true
+		return
+	}
+	if status >= http.StatusInternalServerError && w.stale != nil {
+		w.useStale = true
+		return
+	}
+	w.header = w.Header().Clone()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.useStale || w.notModified {
+		return len(b), nil
+	}
+	if w.capture {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.capture = false
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheWriter) Flush() {
+	if w.useStale || w.notModified {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type cacheRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *cacheRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *cacheRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *cacheRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *cacheRecorder) Flush() {}
+
+// cacheHandler serves fcgi and proxy routes from a cache zone.
+type cacheHandler struct {
+	gen  *generation
+	zone *cacheZone
+	next http.Handler
+}
+
+// newRevalidateRequest builds a background GET for the resource of req that
+// shares no state with it, so it can outlive the client request. Only the
+// local address is carried over from its context.
+func newRevalidateRequest(req *http.Request) *http.Request {
+	u := *req.URL
+	r2 := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &u,
+		Proto:      req.Proto,
+		ProtoMajor: req.ProtoMajor,
+		ProtoMinor: req.ProtoMinor,
+		Header:     req.Header.Clone(),
+		Body:       http.NoBody,
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+		RequestURI: req.RequestURI,
+		TLS:        req.TLS,
+	}
+	ctx := context.Background()
+	if addr := req.Context().Value(http.LocalAddrContextKey); addr != nil {
+		ctx = context.WithValue(ctx, http.LocalAddrContextKey, addr)
+	}
+	return r2.WithContext(ctx)
+}
+
+func (hndlr *cacheHandler) revalidate(primary string, req *http.Request) {
+	zone := hndlr.zone
+	zone.mu.Lock()
+	if zone.updating[primary] {
+		zone.mu.Unlock()
+		return
+	}
+	zone.updating[primary] = true
+	zone.mu.Unlock()
+	done := func() {
+		zone.mu.Lock()
+		delete(zone.updating, primary)
+		zone.mu.Unlock()
+	}
+	if !hndlr.gen.Acquire() {
+		done()
+		return
+	}
+	r2 := newRevalidateRequest(req)
+	r2.Header.Del("If-None-Match")
+	r2.Header.Del("If-Modified-Since")
+	r2.Header.Del("Range")
+	go func() {
+		defer hndlr.gen.Release()
+		defer done()
+		defer func() {
+			if r := recover(); r != nil && r != http.ErrAbortHandler {
+				panic(r)
+			}
+		}()
+		w := &cacheRecorder{header: make(http.Header)}
+		hndlr.next.ServeHTTP(w, r2)
+		if int64(w.body.Len()) > zone.cfg.MaxEntrySize {
+			return
+		}
+		if entry, ok := zone.newEntry(r2, w.status, w.header, w.body.Bytes()); ok {
+			zone.save(primary, r2, entry)
+		}
+	}()
+}
+
+func (hndlr *cacheHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	zone := hndlr.zone
+	if req.Method == "PURGE" {
+		zone.purge(rw, req)
+		return
+	}
+	reqCc := cacheControl(req.Header)
+	_, noStore := reqCc["no-store"]
+	if (req.Method != http.MethodGet && req.Method != http.MethodHead) || noStore || req.Header.Get("Upgrade") != "" {
+		zone.count("bypass")
+		rw.Header().Set("X-Cache", "BYPASS")
+		hndlr.next.ServeHTTP(rw, req)
+		return
+	}
+	primary := zone.key(req)
+	entry := zone.lookup(primary, req)
+	now := time.Now()
+	_, noCache := reqCc["no-cache"]
+	if entry != nil && !noCache {
+		if entry.Fresh(now) {
+			zone.serve(rw, req, entry, "hit")
+			return
+		}
+		if entry.Usable(now, entry.Swr) {
+			zone.serve(rw, req, entry, "stale")
+			hndlr.revalidate(primary, req)
+			return
+		}
+	}
+	w := &cacheWriter{
+		ResponseWriter: rw,
+		limit:          zone.cfg.MaxEntrySize,
+		capture:        req.Method == http.MethodGet,
+	}
+	if entry != nil && entry.Usable(now, entry.Sie) {
+		w.stale = entry
+	}
+	upReq := req
+	if entry != nil && entry.Validators() {
+		w.validated = entry
+		upReq = req.WithContext(req.Context())
+		upReq.Header = req.Header.Clone()
+		upReq.Header.Del("If-None-Match")
+		upReq.Header.Del("If-Modified-Since")
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			upReq.Header.Set("If-None-Match", etag)
+		}
+		if lm := entry.Header.Get("Last-Modified"); lm != "" {
+			upReq.Header.Set("If-Modified-Since", lm)
+		}
+	}
+	rw.Header().Set("X-Cache", "MISS")
+	hndlr.next.ServeHTTP(w, upReq)
+	if w.useStale || w.notModified {
+		for k := range rw.Header() {
+			delete(rw.Header(), k)
+		}
+	}
+	if w.useStale {
+		zone.serve(rw, req, entry, "stale")
+		return
+	}
+	if w.notModified {
+		header := entry.Header.Clone()
+		for k, v := range w.header {
+			if k != "Content-Length" {
+				header[k] = v
+			}
+		}
+		if updated, ok := zone.newEntry(req, entry.Status, header, entry.Body); ok {
+			zone.save(primary, req, updated)
+			entry = updated
+		}
+		zone.serve(rw, req, entry, "revalidated")
+		return
+	}
+	zone.count("miss")
+	if w.capture && w.status != 0 {
+		if entry, ok := zone.newEntry(req, w.status, w.header, w.body.Bytes()); ok {
+			zone.save(primary, req, entry)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheNewEntry(t *testing.T) {
+	zone := &cacheZone{name: "test", cfg: newCacheOpts()}
+	zone.cfg.DefaultTtl = time.Minute
+	zone.cfg.StaleIfError = time.Hour
+	now := time.Now()
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		auth   bool
+		ok     bool
+		ttl    time.Duration
+	}{
+		{"default ttl", 200, http.Header{}, false, true, time.Minute},
+		{"max-age", 200, http.Header{"Cache-Control": {"public, max-age=300"}}, false, true, 5 * time.Minute},
+		{"s-maxage wins", 200, http.Header{"Cache-Control": {"max-age=300, s-maxage=600"}}, false, true, 10 * time.Minute},
+		{"expires", 200, http.Header{"Date": {now.UTC().Format(http.TimeFormat)}, "Expires": {now.Add(2 * time.Hour).UTC().Format(http.TimeFormat)}}, false, true, 2 * time.Hour},
+		{"age", 200, http.Header{"Cache-Control": {"max-age=300"}, "Age": {"100"}}, false, true, 200 * time.Second},
+		{"aged out", 200, http.Header{"Cache-Control": {"max-age=300"}, "Age": {"400"}}, false, false, 0},
+		{"max-age=0", 200, http.Header{"Cache-Control": {"max-age=0"}}, false, false, 0},
+		{"bad expires", 200, http.Header{"Expires": {"0"}}, false, false, 0},
+		{"uncacheable status", 500, http.Header{}, false, false, 0},
+		{"not found", 404, http.Header{}, false, true, time.Minute},
+		{"no-store", 200, http.Header{"Cache-Control": {"no-store"}}, false, false, 0},
+		{"private", 200, http.Header{"Cache-Control": {"private, max-age=60"}}, false, false, 0},
+		{"set-cookie", 200, http.Header{"Set-Cookie": {"id=1"}}, false, false, 0},
+		{"vary star", 200, http.Header{"Vary": {"Accept, *"}}, false, false, 0},
+		{"no-cache without validators", 200, http.Header{"Cache-Control": {"no-cache"}}, false, false, 0},
+		{"no-cache with etag", 200, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}, false, true, time.Minute},
+		{"authorization", 200, http.Header{"Cache-Control": {"max-age=60"}}, true, false, 0},
+		{"authorization public", 200, http.Header{"Cache-Control": {"public, max-age=60"}}, true, true, time.Minute},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+		if tt.auth {
+			req.Header.Set("Authorization", "Basic dTpw")
+		}
+		entry, ok := zone.newEntry(req, tt.status, tt.header, []byte("body"))
+		if ok != tt.ok {
+			t.Errorf("%s: stored = %t, want %t", tt.name, ok, tt.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if ttl := entry.Expires.Sub(now); ttl < tt.ttl-time.Second || ttl > tt.ttl+time.Second {
+			t.Errorf("%s: ttl = %s, want %s", tt.name, ttl, tt.ttl)
+		}
+	}
+}
+
+func TestCacheNewEntryHeaders(t *testing.T) {
+	zone := &cacheZone{name: "test", cfg: newCacheOpts()}
+	zone.cfg.StaleWhileRevalidate = time.Minute
+	req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	header := http.Header{
+		"Cache-Control": {"max-age=60, stale-if-error=30, must-revalidate"},
+		"Vary":          {"accept-encoding, X-Lang"},
+		"Connection":    {"close"},
+		"Age":           {"5"},
+	}
+	entry, ok := zone.newEntry(req, 200, header, nil)
+	if !ok {
+		t.Fatal("entry not stored")
+	}
+	if len(entry.Vary) != 2 || entry.Vary[0] != "Accept-Encoding" || entry.Vary[1] != "X-Lang" {
+		t.Errorf("vary = %v", entry.Vary)
+	}
+	if entry.Swr != time.Minute || entry.Sie != 30*time.Second {
+		t.Errorf("swr = %s, sie = %s", entry.Swr, entry.Sie)
+	}
+	if !entry.MustRevalidate {
+		t.Error("must-revalidate not kept")
+	}
+	if entry.Header.Get("Connection") != "" || entry.Header.Get("Age") != "" {
+		t.Errorf("stored header = %v", entry.Header)
+	}
+	if header.Get("Connection") == "" {
+		t.Error("newEntry changed the response header")
+	}
+}
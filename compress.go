@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressGzip   = "gzip"
+	compressBrotli = "br"
+	compressZstd   = "zstd"
+)
+
+var compressEncodings = []string{compressBrotli, compressZstd, compressGzip}
+
+// precompressedExts maps an encoding to the suffix of the sibling files
+// served in its place from site_root.
+var precompressedExts = map[string]string{
+	compressBrotli: ".br",
+	compressGzip:   ".gz",
+}
+
+type compressEncoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var compressPools = map[string]*sync.Pool{
+	compressGzip: {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+	compressBrotli: {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+	}},
+	compressZstd: {New: func() interface{} {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			log.Printf("Compress error: encoding=%s err=%v", compressZstd, err)
+			return nil
+		}
+		return enc
+	}},
+}
+
+func parseAcceptEncoding(header string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	return accepted
+}
+
+// negotiateEncoding picks the encoding the client rates highest, with
+// ties going to the earlier entry of encodings.
+func negotiateEncoding(req *http.Request, encodings []string) string {
+	accepted := parseAcceptEncoding(req.Header.Get("Accept-Encoding"))
+	best, bestQ := "", 0.0
+	for _, enc := range encodings {
+		q, ok := accepted[enc]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+func compressibleType(types []string, contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, t := range types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter holds back the first min_size bytes of a response to
+// decide whether it is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	req      *http.Request
+	opts     *cfgCompressOpts
+	encoding string
+	status   int
+	buf      []byte
+	started  bool
+	enc      compressEncoder
+}
+
+// contentType returns the type net/http would send: the header if the
+// handler set one, else the type sniffed from the buffered body.
+func (w *compressWriter) contentType() (ctype string, sniffed bool) {
+	if _, ok := w.Header()["Content-Type"]; ok || len(w.buf) == 0 {
+		return w.Header().Get("Content-Type"), false
+	}
+	return http.DetectContentType(w.buf), true
+}
+
+func (w *compressWriter) eligible() bool {
+	h := w.Header()
+	switch {
+	case w.req.Method == http.MethodHead:
+		return false
+	case w.status == http.StatusNoContent, w.status == http.StatusNotModified, w.status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "":
+		return false
+	case strings.Contains(h.Get("Cache-Control"), "no-transform"):
+		return false
+	}
+	ctype, _ := w.contentType()
+	return compressibleType(w.opts.Types, ctype)
+}
+
+func (w *compressWriter) start(compress bool) (err error) {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	h := w.Header()
+	if w.eligible() {
+		addVary(h, "Accept-Encoding")
+		if compress && w.encoding != "" {
+			w.enc, _ = compressPools[w.encoding].Get().(compressEncoder)
+		}
+		if w.enc != nil {
+			if ctype, sniffed := w.contentType(); sniffed {
+				h.Set("Content-Type", ctype)
+			}
+			w.enc.Reset(w.ResponseWriter)
+			h.Set("Content-Encoding", w.encoding)
+			h.Del("Content-Length")
+			h.Del("Accept-Ranges")
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) > 0 {
+		if w.enc != nil {
+			_, err = w.enc.Write(w.buf)
+		} else {
+			_, err = w.ResponseWriter.Write(w.buf)
+		}
+	}
+	w.buf = nil
+	return
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.started || w.status != 0 {
+		return
+	}
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) >= w.opts.MinSize {
+			if err := w.start(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush starts the response with what is buffered, as a handler that
+// flushes streams its output and min_size would hold it back. Event
+// streams and bodies known to be smaller than min_size stay uncompressed.
+func (w *compressWriter) Flush() {
+	if !w.started {
+		compress := !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+		if size, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil && size < w.opts.MinSize {
+			compress = false
+		}
+		if err := w.start(compress); err != nil {
+			return
+		}
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		w.started = true
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("http.Hijacker not supported")
+}
+
+func (w *compressWriter) Close() {
+	if !w.started && (w.status != 0 || len(w.buf) > 0) {
+		w.start(false)
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(nil)
+		compressPools[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+type compressHandler struct {
+	opts *cfgCompressOpts
+	next http.Handler
+}
+
+func (hndlr *compressHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	w := &compressWriter{
+		ResponseWriter: rw,
+		req:            req,
+		opts:           hndlr.opts,
+		encoding:       negotiateEncoding(req, hndlr.opts.Encodings),
+	}
+	defer w.Close()
+	hndlr.next.ServeHTTP(w, req)
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+type cfgProblem struct {
+	path []interface{}
+	msg  string
+	file string
+	line int
+}
+
+func (p *cfgProblem) Path() string {
+	ret := ""
+	for _, v := range p.path {
+		switch k := v.(type) {
+		case int:
+			ret = fmt.Sprintf("%s[%d]", ret, k)
+		default:
+			if ret == "" {
+				ret = fmt.Sprintf("%v", k)
+			} else {
+				ret = fmt.Sprintf("%s.%v", ret, k)
+			}
+		}
+	}
+	return ret
+}
+
+type cfgProblems struct {
+	problems []*cfgProblem
+}
+
+func (probs *cfgProblems) Add(msg string, path ...interface{}) {
+	path = append([]interface{}(nil), path...)
+	probs.problems = append(probs.problems, &cfgProblem{path: path, msg: msg})
+}
+
+func (probs *cfgProblems) Error() string {
+	ret := fmt.Sprintf("%d problem(s) found", len(probs.problems))
+	for _, p := range probs.problems {
+		ret = fmt.Sprintf("%s\n  %s:%d: %s: %s", ret, p.file, p.line, p.Path(), p.msg)
+	}
+	return ret
+}
+
+// resolveLines looks up the file and line of each problem's path in the
+// yaml sources the config was merged from.
+func (probs *cfgProblems) resolveLines(cfg *config) {
+	roots := make(map[*cfgSource]*yaml3.Node)
+	for _, p := range probs.problems {
+		src, path := cfg.origin(p.path)
+		p.file = src.file
+		p.path = path
+		root, ok := roots[src]
+		if !ok {
+			var doc yaml3.Node
+			if err := yaml3.Unmarshal(src.source, &doc); err == nil {
+				root = &doc
+				if root.Kind == yaml3.DocumentNode && len(root.Content) > 0 {
+					root = root.Content[0]
+				}
+			}
+			roots[src] = root
+		}
+		if root != nil {
+			p.line = yamlLine(root, p.path)
+		}
+	}
+	order := make(map[string]int)
+	for idx, src := range cfg.sources {
+		order[src.file] = idx
+	}
+	sort.SliceStable(probs.problems, func(i, j int) bool {
+		a, b := probs.problems[i], probs.problems[j]
+		if a.file != b.file {
+			return order[a.file] < order[b.file]
+		}
+		return a.line < b.line
+	})
+}
+
+func yamlLine(node *yaml3.Node, path []interface{}) int {
+	line := node.Line
+	for _, v := range path {
+		switch k := v.(type) {
+		case string:
+			if node.Kind != yaml3.MappingNode {
+				return line
+			}
+			found := false
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == k {
+					line = node.Content[i].Line
+					node = node.Content[i+1]
+					found = true
+					break
+				}
+			}
+			if !found {
+				return line
+			}
+		case int:
+			if node.Kind != yaml3.SequenceNode || k >= len(node.Content) {
+				return line
+			}
+			node = node.Content[k]
+			line = node.Line
+		}
+	}
+	return line
+}
+
+// checkScriptFormat makes sure an fcgi_script has exactly one %s verb.
+func checkScriptFormat(script string) error {
+	verbs := 0
+	for i := 0; i < len(script); i++ {
+		if script[i] != '%' {
+			continue
+		}
+		if i+1 >= len(script) {
+			return fmt.Errorf("trailing %%")
+		}
+		i++
+		switch script[i] {
+		case '%':
+		case 's':
+			verbs++
+		default:
+			return fmt.Errorf("unsupported verb %%%c, only %%s is allowed", script[i])
+		}
+	}
+	if verbs != 1 {
+		return fmt.Errorf("must contain exactly one %%s, found %d", verbs)
+	}
+	return nil
+}
+
+func checkFile(probs *cfgProblems, name string, path ...interface{}) {
+	if name == "" {
+		probs.Add("file not set", path...)
+	} else if fi, err := os.Stat(name); err != nil {
+		probs.Add(err.Error(), path...)
+	} else if fi.IsDir() {
+		probs.Add(fmt.Sprintf("%s is a directory", name), path...)
+	}
+}
+
+// checkDir reports a directory that does not exist, or with create set,
+// that cannot be created because an existing part of its path is a file.
+func checkDir(probs *cfgProblems, name string, create bool, path ...interface{}) {
+	for dir := filepath.Clean(name); ; dir = filepath.Dir(dir) {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				probs.Add(fmt.Sprintf("%s is not a directory", dir), path...)
+			}
+			return
+		}
+		if !create || !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			probs.Add(err.Error(), path...)
+			return
+		}
+	}
+}
+
+func checkAccessLog(probs *cfgProblems, cfg *cfgAccessLog, path ...interface{}) {
+	if cfg == nil {
+		return
+	}
+	switch cfg.Format {
+	case "", accessLogCombined, accessLogJson:
+	case accessLogTemplate:
+		if _, err := newAccessLogTemplate(cfg.Template); err != nil {
+			probs.Add(err.Error(), append(path, "template")...)
+		}
+	default:
+		probs.Add(fmt.Sprintf("unknown access log format %q", cfg.Format), append(path, "format")...)
+	}
+}
+
+func checkStaticOpts(probs *cfgProblems, cfg *cfgStaticOpts, path ...interface{}) {
+	if cfg == nil {
+		return
+	}
+	for i, index := range cfg.Index {
+		if index == "" || strings.Contains(index, "/") {
+			probs.Add(fmt.Sprintf("invalid index file %q", index), append(path, "index", i)...)
+		}
+	}
+	for i, entry := range cfg.TryFiles {
+		if strings.HasPrefix(entry, "=") {
+			if code, err := strconv.Atoi(entry[1:]); err != nil || code < 100 || code > 999 {
+				probs.Add(fmt.Sprintf("invalid status code %q", entry), append(path, "try_files", i)...)
+			} else if i != len(cfg.TryFiles)-1 {
+				probs.Add("a status code is only allowed as the last entry", append(path, "try_files", i)...)
+			}
+		} else if !strings.HasPrefix(entry, "/") && !strings.HasPrefix(entry, "$uri") {
+			probs.Add(fmt.Sprintf("entry %q must start with / or $uri", entry), append(path, "try_files", i)...)
+		}
+	}
+}
+
+func checkCompressOpts(probs *cfgProblems, cfg *cfgCompressOpts, path ...interface{}) {
+	if cfg == nil {
+		return
+	}
+	for i, enc := range cfg.Encodings {
+		if !strSliceContains(compressEncodings, enc) {
+			probs.Add(fmt.Sprintf("unknown encoding %q, expected one of %s", enc, strings.Join(compressEncodings, ", ")), append(path, "encodings", i)...)
+		}
+	}
+	if cfg.MinSize < 0 {
+		probs.Add("min_size must not be negative", append(path, "min_size")...)
+	}
+}
+
+func checkHttp2Opts(probs *cfgProblems, cfg *cfgHttp2Opts, path ...interface{}) {
+	if cfg == nil {
+		return
+	}
+	if cfg.MaxReadFrameSize != 0 && (cfg.MaxReadFrameSize < 1<<14 || cfg.MaxReadFrameSize > 1<<24-1) {
+		probs.Add("max_read_frame_size must be between 16384 and 16777215", append(path, "max_read_frame_size")...)
+	}
+	if cfg.ConnWindowSize != 0 && cfg.ConnWindowSize < 65535 {
+		probs.Add("conn_window_size must be at least 65535", append(path, "conn_window_size")...)
+	}
+	if cfg.StreamWindowSize != 0 && cfg.StreamWindowSize < 65535 {
+		probs.Add("stream_window_size must be at least 65535", append(path, "stream_window_size")...)
+	}
+}
+
+func checkAcmeOpts(probs *cfgProblems, cfg *cfgAcmeOpts, path ...interface{}) {
+	if cfg == nil {
+		return
+	}
+	if cfg.Dir == "" {
+		probs.Add("dir not set", path...)
+	}
+	if u, err := url.Parse(cfg.DirectoryUrl); err != nil {
+		probs.Add(err.Error(), append(path, "directory_url")...)
+	} else if u.Scheme != "https" || u.Host == "" {
+		probs.Add(fmt.Sprintf("directory_url %q must be an https url", cfg.DirectoryUrl), append(path, "directory_url")...)
+	}
+	if cfg.CaCert != "" {
+		checkFile(probs, cfg.CaCert, append(path, "ca_cert")...)
+	}
+}
+
+func checkCaches(probs *cfgProblems, caches cfgCacheMap) {
+	caches.Each(func(name string, cacheOpts *cfgCacheOpts) bool {
+		if cacheOpts == nil {
+			probs.Add("no cache options", "cache", name)
+			return true
+		}
+		if !strSliceContains(cacheStoreTypes, cacheOpts.Store) {
+			probs.Add(fmt.Sprintf("unknown store %q, expected one of %s", cacheOpts.Store, strings.Join(cacheStoreTypes, ", ")), "cache", name, "store")
+		} else if cacheOpts.Store == cacheDisk && cacheOpts.Dir == "" {
+			probs.Add("dir not set for disk store", "cache", name)
+		}
+		if cacheOpts.MaxSize <= 0 {
+			probs.Add("max_size must be positive", "cache", name, "max_size")
+		}
+		if cacheOpts.MaxEntrySize <= 0 {
+			probs.Add("max_entry_size must be positive", "cache", name, "max_entry_size")
+		}
+		if cacheOpts.Key == "" {
+			probs.Add("key not set", "cache", name, "key")
+		}
+		if _, err := parseCidrs(cacheOpts.PurgeAllow); err != nil {
+			probs.Add(err.Error(), "cache", name, "purge_allow")
+		}
+		return true
+	})
+}
+
+func checkServerMap(probs *cfgProblems, servers cfgServerMap, section string, urls bool) {
+	servers.Each(func(label string, grp *cfgServerGroup) bool {
+		if grp == nil || len(grp.Servers) == 0 {
+			probs.Add("no servers listed", section, label)
+			return true
+		}
+		if grp.LbPolicy != "" && !strSliceContains(lbPolicies, grp.LbPolicy) {
+			probs.Add(fmt.Sprintf("unknown lb_policy %q, expected one of %s", grp.LbPolicy, strings.Join(lbPolicies, ", ")), section, label, "lb_policy")
+		}
+		if k := grp.LbHashKey; k != "" && k != "ip" && !strings.HasPrefix(k, "cookie:") && !strings.HasPrefix(k, "header:") {
+			probs.Add(fmt.Sprintf("invalid lb_hash_key %q, expected ip, cookie:NAME or header:NAME", k), section, label, "lb_hash_key")
+		}
+		if grp.Pool != nil {
+			if grp.Pool.MaxConns < 0 {
+				probs.Add("max_conns must not be negative", section, label, "pool", "max_conns")
+			}
+			if grp.Pool.Multiplex && !grp.Pool.KeepConn {
+				probs.Add("multiplex needs keep_conn", section, label, "pool", "multiplex")
+			}
+		}
+		for server := range grp.Weights {
+			if !strSliceContains(grp.Servers, server) {
+				probs.Add(fmt.Sprintf("weight for unknown server %q", server), section, label, "weights", server)
+			}
+		}
+		if urls {
+			grp.Servers.Each(func(idx int, server string) bool {
+				if u, err := url.Parse(server); err != nil {
+					probs.Add(err.Error(), section, label, "servers", idx)
+				} else if u.Scheme == "" || u.Host == "" {
+					probs.Add(fmt.Sprintf("server %q must be an absolute url", server), section, label, "servers", idx)
+				}
+				return true
+			})
+		}
+		return true
+	})
+}
+
+// listenConflict tells whether two different addresses cannot both be
+// bound because they share a port and one of them listens on every
+// address, as ":443", "0.0.0.0:443" and "[::]:443" do.
+func listenConflict(a, b string) bool {
+	wildcard := func(host string) bool {
+		ip := net.ParseIP(host)
+		return host == "" || ip != nil && ip.IsUnspecified()
+	}
+	aHost, aPort := splitHostPort(a)
+	bHost, bPort := splitHostPort(b)
+	return a != b && aPort == bPort && (wildcard(aHost) || wildcard(bHost))
+}
+
+// Validate checks the whole configuration and reports every problem it
+// finds at once.
+func (cfg *config) Validate() error {
+	probs := &cfgProblems{}
+	checkServerMap(probs, cfg.FCgiServers, "fcgi", false)
+	checkServerMap(probs, cfg.ProxyServers, "proxy", true)
+	checkAccessLog(probs, cfg.AccessLog, "access_log")
+	checkCaches(probs, cfg.Caches)
+	checkAcmeOpts(probs, cfg.Acme, "acme")
+
+	sslByAddr := make(map[string]bool)
+	sslDefaultByAddr := make(map[string]int)
+	firstByAddr := make(map[string]int)
+	var addrs []string
+	hostsByAddr := make(map[string]map[string]bool)
+	patternsByAddr := make(map[string]map[string]bool)
+	cfg.Sites.Each(func(idx int, site *cfgSite) bool {
+		if site.Port == "" {
+			probs.Add("site_port not set", "sites", idx)
+		}
+		laddr := site.Addr()
+		if ssl, ok := sslByAddr[laddr]; ok {
+			if ssl != site.SslOn {
+				probs.Add(fmt.Sprintf("%s mixes ssl and non-ssl sites (see sites[%d])", laddr, firstByAddr[laddr]), "sites", idx, "site_ssl_on")
+			}
+			if first := cfg.Sites[firstByAddr[laddr]]; site.Http2 != nil && first.Http2 != nil && *site.Http2 != *first.Http2 {
+				probs.Add(fmt.Sprintf("%s has different site_http2 options (see sites[%d])", laddr, firstByAddr[laddr]), "sites", idx, "site_http2")
+			}
+			if first := cfg.Sites[firstByAddr[laddr]]; site.Http3 != nil && first.Http3 != nil && *site.Http3 != *first.Http3 {
+				probs.Add(fmt.Sprintf("%s has different site_http3 options (see sites[%d])", laddr, firstByAddr[laddr]), "sites", idx, "site_http3")
+			}
+		} else {
+			for _, other := range addrs {
+				if listenConflict(laddr, other) {
+					probs.Add(fmt.Sprintf("%s and %s listen on the same port (see sites[%d])", laddr, other, firstByAddr[other]), "sites", idx, "site_ip")
+					break
+				}
+			}
+			addrs = append(addrs, laddr)
+			sslByAddr[laddr] = site.SslOn
+			firstByAddr[laddr] = idx
+			hostsByAddr[laddr] = make(map[string]bool)
+			patternsByAddr[laddr] = make(map[string]bool)
+		}
+		if site.Root != "" {
+			if hostsByAddr[laddr][strings.ToLower(site.Host)] {
+				probs.Add(fmt.Sprintf("host %q is already served on %s", site.Host, laddr), "sites", idx, "site_host")
+			}
+			hostsByAddr[laddr][strings.ToLower(site.Host)] = true
+			if fi, err := os.Stat(site.Root); err != nil {
+				probs.Add(err.Error(), "sites", idx, "site_root")
+			} else if !fi.IsDir() {
+				probs.Add(fmt.Sprintf("%s is not a directory", site.Root), "sites", idx, "site_root")
+			}
+		}
+		if site.MaxBodySize < 0 {
+			probs.Add("must not be negative", "sites", idx, "site_max_body_size")
+		}
+		if site.BodyBufferSize < 0 {
+			probs.Add("must not be negative", "sites", idx, "site_body_buffer_size")
+		}
+		checkStaticOpts(probs, site.Static, "sites", idx, "site_static")
+		checkCompressOpts(probs, site.Compress, "sites", idx, "site_compress")
+		checkHttp2Opts(probs, site.Http2, "sites", idx, "site_http2")
+		if site.Http3 != nil && site.Http3.Enabled && !site.SslOn {
+			probs.Add("http3 needs site_ssl_on", "sites", idx, "site_http3", "enabled")
+		}
+		if site.SslOn {
+			if site.SslOpts == nil {
+				probs.Add("site_ssl_opts not set", "sites", idx)
+			} else if site.SslOpts.Acme {
+				if site.Host == "" || net.ParseIP(site.Host) != nil {
+					probs.Add("ssl_acme needs a site_host name", "sites", idx, "site_ssl_opts", "ssl_acme")
+				}
+				if site.SslOpts.Cert != "" || site.SslOpts.Key != "" {
+					probs.Add("ssl_acme cannot be combined with ssl_cert and ssl_key", "sites", idx, "site_ssl_opts", "ssl_acme")
+				}
+			} else {
+				checkFile(probs, site.SslOpts.Cert, "sites", idx, "site_ssl_opts", "ssl_cert")
+				checkFile(probs, site.SslOpts.Key, "sites", idx, "site_ssl_opts", "ssl_key")
+				if site.SslOpts.Chain != "" {
+					checkFile(probs, site.SslOpts.Chain, "sites", idx, "site_ssl_opts", "ssl_chain")
+				}
+				if site.SslOpts.Default {
+					if first, ok := sslDefaultByAddr[laddr]; ok {
+						probs.Add(fmt.Sprintf("%s already has a default certificate (see sites[%d])", laddr, first), "sites", idx, "site_ssl_opts", "ssl_default")
+					} else {
+						sslDefaultByAddr[laddr] = idx
+					}
+				}
+			}
+		}
+		checkPattern := func(pattern string, path ...interface{}) {
+			if pattern == "" {
+				probs.Add("pattern not set", path...)
+			} else if _, err := regexp.Compile(pattern); err != nil {
+				probs.Add(err.Error(), path...)
+			} else if patternsByAddr[laddr][site.Host+pattern] {
+				probs.Add(fmt.Sprintf("pattern %q is already registered for %s on %s", pattern, site.Host, laddr), path...)
+			}
+			patternsByAddr[laddr][site.Host+pattern] = true
+		}
+		site.FCgi.Each(func(i int, fCgiOpts *cfgFCgiOpts) bool {
+			if _, ok := cfg.FCgiServers.Get(fCgiOpts.Server); !ok {
+				probs.Add(fmt.Sprintf("unknown fcgi server label %q", fCgiOpts.Server), "sites", idx, "site_fcgi", i, "fcgi_server")
+			}
+			checkPattern(fCgiOpts.Pattern, "sites", idx, "site_fcgi", i, "fcgi_pattern")
+			if fCgiOpts.SplitPath != "" {
+				if re, err := regexp.Compile(fCgiOpts.SplitPath); err != nil {
+					probs.Add(err.Error(), "sites", idx, "site_fcgi", i, "fcgi_split_path")
+				} else if re.NumSubexp() != 2 {
+					probs.Add("must have two capture groups, the script name and the path info", "sites", idx, "site_fcgi", i, "fcgi_split_path")
+				}
+			}
+			if _, ok := cfg.Caches.Get(fCgiOpts.Cache); fCgiOpts.Cache != "" && !ok {
+				probs.Add(fmt.Sprintf("unknown cache %q", fCgiOpts.Cache), "sites", idx, "site_fcgi", i, "fcgi_cache")
+			}
+			if err := checkScriptFormat(fCgiOpts.Script); err != nil {
+				probs.Add(fmt.Sprintf("invalid fcgi_script %q: %v", fCgiOpts.Script, err), "sites", idx, "site_fcgi", i, "fcgi_script")
+			}
+			return true
+		})
+		site.Proxy.Each(func(i int, proxyOpts *cfgProxyOpts) bool {
+			if _, ok := cfg.ProxyServers.Get(proxyOpts.Server); !ok {
+				probs.Add(fmt.Sprintf("unknown proxy server label %q", proxyOpts.Server), "sites", idx, "site_proxy", i, "proxy_server")
+			}
+			checkPattern(proxyOpts.Pattern, "sites", idx, "site_proxy", i, "proxy_pattern")
+			if _, ok := cfg.Caches.Get(proxyOpts.Cache); proxyOpts.Cache != "" && !ok {
+				probs.Add(fmt.Sprintf("unknown cache %q", proxyOpts.Cache), "sites", idx, "site_proxy", i, "proxy_cache")
+			}
+			return true
+		})
+		checkAccessLog(probs, site.AccessLog, "sites", idx, "site_access_log")
+		return true
+	})
+	if cfg.Metrics != nil && cfg.Metrics.Listen != "" {
+		for _, laddr := range addrs {
+			if laddr == cfg.Metrics.Listen || listenConflict(laddr, cfg.Metrics.Listen) {
+				probs.Add(fmt.Sprintf("%s is already used by a site", cfg.Metrics.Listen), "metrics", "listen")
+				break
+			}
+		}
+		if !strings.HasPrefix(cfg.Metrics.Path, "/") {
+			probs.Add("path must start with /", "metrics", "path")
+		}
+	}
+	if len(probs.problems) == 0 {
+		return nil
+	}
+	probs.resolveLines(cfg)
+	return probs
+}
+
+// checkConfig surfaces what Validate cannot see from the config alone:
+// certificates that fail to load and log, cache and ACME directories that
+// cannot be used. Unlike building a generation it starts no pools, health
+// checks, loggers, caches or ACME managers, and creates no files.
+func checkConfig(cfg *config) error {
+	probs := &cfgProblems{}
+	checkLogDir := func(logCfg *cfgAccessLog, path ...interface{}) {
+		if logCfg != nil && logCfg.File != "" {
+			checkDir(probs, filepath.Dir(logCfg.File), false, path...)
+		}
+	}
+	checkLogDir(cfg.AccessLog, "access_log", "file")
+	cfg.Caches.Each(func(name string, cacheOpts *cfgCacheOpts) bool {
+		if cacheOpts.Store == cacheDisk {
+			checkDir(probs, cacheOpts.Dir, true, "cache", name, "dir")
+		}
+		return true
+	})
+	loaded := make(map[cfgSslOpts]bool)
+	acme := false
+	cfg.Sites.Each(func(idx int, site *cfgSite) bool {
+		if site.SslOn && site.SslOpts.Acme {
+			acme = true
+		} else if site.SslOn && !loaded[*site.SslOpts] {
+			loaded[*site.SslOpts] = true
+			if _, err := loadCertificate(site.SslOpts); err != nil {
+				probs.Add(err.Error(), "sites", idx, "site_ssl_opts")
+			}
+		}
+		checkLogDir(site.AccessLog, "sites", idx, "site_access_log", "file")
+		return true
+	})
+	if acme {
+		if cfg.Acme != nil {
+			checkDir(probs, cfg.Acme.Dir, true, "acme", "dir")
+		} else {
+			checkDir(probs, newAcmeOpts().Dir, true, "acme")
+		}
+	}
+	if len(probs.problems) == 0 {
+		return nil
+	}
+	probs.resolveLines(cfg)
+	return probs
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestConfig(t *testing.T, sites string, rest string) (*config, error) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	yml := strings.ReplaceAll("sites:\n"+sites+rest, "ROOT", dir)
+	if err := ioutil.WriteFile(path, []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(path)
+}
+
+func TestValidateOk(t *testing.T) {
+	cfg, err := loadTestConfig(t, `
+  - site_host: www.example.com
+    site_port: "8080"
+    site_root: ROOT
+    site_fcgi:
+      - fcgi_server: php
+        fcgi_pattern: "\\.php$"
+        fcgi_script: "ROOT%s"
+  - site_host: api.example.com
+    site_port: "8080"
+    site_root: ROOT
+    site_proxy:
+      - proxy_server: api
+        proxy_pattern: "^/"
+`, `
+fcgi:
+  php: ["127.0.0.1:9000"]
+proxy:
+  api: ["http://127.0.0.1:9001"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Sites) != 2 {
+		t.Errorf("loaded %d sites, want 2", len(cfg.Sites))
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+	tests := []struct {
+		name  string
+		sites string
+		rest  string
+		probs []string
+	}{
+		{
+			name: "port not set",
+			sites: `
+  - site_host: a.com
+    site_root: ROOT
+`,
+			probs: []string{"sites[0]: site_port not set"},
+		},
+		{
+			name: "duplicate host",
+			sites: `
+  - { site_host: a.com, site_port: "8080", site_root: ROOT }
+  - { site_host: A.com, site_port: "8080", site_root: ROOT }
+`,
+			probs: []string{`sites[1].site_host: host "A.com" is already served on :8080`},
+		},
+		{
+			name: "wildcard and address on one port",
+			sites: `
+  - { site_host: a.com, site_port: "8080", site_root: ROOT }
+  - { site_host: b.com, site_ip: 127.0.0.1, site_port: "8080", site_root: ROOT }
+  - { site_host: c.com, site_ip: 127.0.0.1, site_port: "8081", site_root: ROOT }
+`,
+			probs: []string{"sites[1].site_ip: 127.0.0.1:8080 and :8080 listen on the same port (see sites[0])"},
+		},
+		{
+			name: "mixed ssl",
+			sites: `
+  - { site_host: a.com, site_port: "8443", site_root: ROOT }
+  - { site_host: b.com, site_port: "8443", site_root: ROOT, site_ssl_on: true, site_ssl_opts: { ssl_acme: true } }
+`,
+			rest:  "acme:\n  dir: ROOT\n",
+			probs: []string{"sites[1].site_ssl_on: :8443 mixes ssl and non-ssl sites (see sites[0])"},
+		},
+		{
+			name: "unknown server labels",
+			sites: `
+  - site_host: a.com
+    site_port: "8080"
+    site_root: ROOT
+    site_fcgi:
+      - { fcgi_server: php, fcgi_pattern: "(", fcgi_script: "ROOT%s" }
+    site_proxy:
+      - { proxy_server: api, proxy_pattern: "^/" }
+`,
+			probs: []string{
+				`sites[0].site_fcgi[0].fcgi_server: unknown fcgi server label "php"`,
+				"sites[0].site_fcgi[0].fcgi_pattern: error parsing regexp",
+				`sites[0].site_proxy[0].proxy_server: unknown proxy server label "api"`,
+			},
+		},
+		{
+			name: "negative sizes",
+			sites: `
+  - { site_host: a.com, site_port: "8080", site_root: ROOT, site_max_body_size: -1, site_body_buffer_size: -1 }
+`,
+			probs: []string{
+				"sites[0].site_max_body_size: must not be negative",
+				"sites[0].site_body_buffer_size: must not be negative",
+			},
+		},
+	}
+	for _, tt := range tests {
+		_, err := loadTestConfig(t, tt.sites, tt.rest)
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		msg := err.Error()
+		if !strings.HasPrefix(msg, fmt.Sprintf("%d problem(s) found", len(tt.probs))) {
+			t.Errorf("%s: %s", tt.name, msg)
+			continue
+		}
+		for _, prob := range tt.probs {
+			if !strings.Contains(msg, prob) {
+				t.Errorf("%s: %q not reported in:\n%s", tt.name, prob, msg)
+			}
+		}
+	}
+}
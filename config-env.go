@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+var envPattern = regexp.MustCompile(`\$\{(?:file:([^}]+)|([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?)\}`)
+
+const redacted = "******"
+
+// interpolate expands ${VAR} and ${VAR:-default} references, where the
+// default also replaces an empty value, and ${file:/path} references with
+// the contents of that file without the trailing newline.
+func interpolate(v string) (string, error) {
+	var err error
+	v = envPattern.ReplaceAllStringFunc(v, func(m string) string {
+		sub := envPattern.FindStringSubmatch(m)
+		if sub[1] != "" {
+			b, ferr := ioutil.ReadFile(sub[1])
+			if ferr != nil {
+				if err == nil {
+					err = ferr
+				}
+				return ""
+			}
+			return strings.TrimRight(string(b), "\r\n")
+		}
+		val, ok := os.LookupEnv(sub[2])
+		if sub[3] != "" && val == "" {
+			return sub[4]
+		}
+		if ok {
+			return val
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", sub[2])
+		}
+		return ""
+	})
+	return v, err
+}
+
+func interpolateValue(probs *cfgProblems, val reflect.Value, path []interface{}) {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !val.IsNil() {
+			interpolateValue(probs, val.Elem(), path)
+		}
+	case reflect.Struct:
+		t := val.Type()
+		for i := 0; i < val.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			interpolateValue(probs, val.Field(i), append(path, name))
+		}
+	case reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			interpolateValue(probs, val.Index(i), append(path, i))
+		}
+	case reflect.Map:
+		for _, k := range val.MapKeys() {
+			elem := val.MapIndex(k)
+			p := append(path, fmt.Sprintf("%v", k.Interface()))
+			if elem.Kind() == reflect.String {
+				if s, err := interpolate(elem.String()); err != nil {
+					probs.Add(err.Error(), p...)
+				} else if s != elem.String() {
+					val.SetMapIndex(k, reflect.ValueOf(s).Convert(elem.Type()))
+				}
+			} else {
+				interpolateValue(probs, elem, p)
+			}
+		}
+	case reflect.String:
+		if val.CanSet() {
+			if s, err := interpolate(val.String()); err != nil {
+				probs.Add(err.Error(), path...)
+			} else {
+				val.SetString(s)
+			}
+		}
+	}
+}
+
+// Interpolate applies environment and secret-file interpolation to every
+// string in the config tree.
+func (cfg *config) Interpolate() error {
+	probs := &cfgProblems{}
+	interpolateValue(probs, reflect.ValueOf(cfg), nil)
+	if len(probs.problems) == 0 {
+		return nil
+	}
+	probs.resolveLines(cfg)
+	return probs
+}
+
+func redact(v string) string {
+	if v == "" {
+		return v
+	}
+	return redacted
+}
+
+func redactUrl(v string) string {
+	if u, err := url.Parse(v); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			return u.String()
+		}
+	}
+	return v
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("GSW_HOST", "www.example.com")
+	t.Setenv("GSW_EMPTY", "")
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"${GSW_HOST}", "www.example.com"},
+		{"https://${GSW_HOST}/", "https://www.example.com/"},
+		{"${GSW_EMPTY}", ""},
+		{"${GSW_EMPTY:-fallback}", "fallback"},
+		{"${GSW_HOST:-fallback}", "www.example.com"},
+		{"${GSW_UNSET:-}", ""},
+		{"${GSW_UNSET:-a b}", "a b"},
+		{"${file:" + secret + "}", "s3cret"},
+		{"file:" + secret, "file:" + secret},
+		{"$GSW_HOST", "$GSW_HOST"},
+	}
+	for _, tt := range tests {
+		got, err := interpolate(tt.in)
+		if err != nil {
+			t.Errorf("interpolate(%q): %v", tt.in, err)
+		} else if got != tt.want {
+			t.Errorf("interpolate(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestInterpolateErrors(t *testing.T) {
+	for _, in := range []string{
+		"${GSW_UNSET}",
+		"a ${GSW_UNSET} b",
+		"${file:" + filepath.Join(t.TempDir(), "missing") + "}",
+	} {
+		if _, err := interpolate(in); err == nil {
+			t.Errorf("interpolate(%q): expected an error", in)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+type cfgSource struct {
+	file   string
+	source []byte
+}
+
+// cfgOrigin records where a site or upstream group was defined so
+// problems can be reported against the right file and line.
+type cfgOrigin struct {
+	src *cfgSource
+	idx int
+}
+
+type cfgInclude struct {
+	Include      []string     `yaml:"include"`
+	Sites        cfgSiteList  `yaml:"sites"`
+	FCgiServers  cfgServerMap `yaml:"fcgi"`
+	ProxyServers cfgServerMap `yaml:"proxy"`
+}
+
+func mergeServerMap(dst cfgServerMap, src cfgServerMap, origins map[string]*cfgSource, from *cfgSource, section string) (cfgServerMap, error) {
+	if dst == nil {
+		dst = make(cfgServerMap)
+	}
+	for label, grp := range src {
+		if prev, ok := origins[label]; ok {
+			return dst, fmt.Errorf("%s: %s label %q is already defined in %s", from.file, section, label, prev.file)
+		}
+		dst[label] = grp
+		origins[label] = from
+	}
+	return dst, nil
+}
+
+func (cfg *config) merge(inc *cfgInclude, src *cfgSource) (err error) {
+	for idx, site := range inc.Sites {
+		cfg.Sites = append(cfg.Sites, site)
+		cfg.siteOrigins = append(cfg.siteOrigins, &cfgOrigin{src: src, idx: idx})
+	}
+	if cfg.FCgiServers, err = mergeServerMap(cfg.FCgiServers, inc.FCgiServers, cfg.fCgiOrigins, src, "fcgi"); err != nil {
+		return
+	}
+	cfg.ProxyServers, err = mergeServerMap(cfg.ProxyServers, inc.ProxyServers, cfg.proxyOrigins, src, "proxy")
+	return
+}
+
+// loadIncludes expands the include globs of a file relative to its
+// directory and merges every matched file into cfg.
+func (cfg *config) loadIncludes(patterns []string, from string, seen map[string]bool) error {
+	dir := filepath.Dir(from)
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		cfg.includeGlobs = append(cfg.includeGlobs, pattern)
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: include %q: %v", from, pattern, err)
+		}
+		sort.Strings(matches)
+		for _, name := range matches {
+			abs, _ := filepath.Abs(name)
+			if seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			file, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			inc := new(cfgInclude)
+			if err = yaml.UnmarshalStrict(file, inc); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			src := &cfgSource{file: name, source: file}
+			cfg.sources = append(cfg.sources, src)
+			if err = cfg.merge(inc, src); err != nil {
+				return err
+			}
+			if err = cfg.loadIncludes(inc.Include, name, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// origin maps a problem path in the merged config back to the file that
+// defined it and the path inside that file.
+func (cfg *config) origin(path []interface{}) (*cfgSource, []interface{}) {
+	main := cfg.sources[0]
+	if len(path) < 2 {
+		return main, path
+	}
+	switch path[0] {
+	case "sites":
+		if idx, ok := path[1].(int); ok && idx < len(cfg.siteOrigins) {
+			o := cfg.siteOrigins[idx]
+			local := append([]interface{}{"sites", o.idx}, path[2:]...)
+			return o.src, local
+		}
+	case "fcgi":
+		if label, ok := path[1].(string); ok && cfg.fCgiOrigins[label] != nil {
+			return cfg.fCgiOrigins[label], path
+		}
+	case "proxy":
+		if label, ok := path[1].(string); ok && cfg.proxyOrigins[label] != nil {
+			return cfg.proxyOrigins[label], path
+		}
+	}
+	return main, path
+}
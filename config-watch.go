@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchFiles lists the config file and every file the include globs match
+// right now. Certificate files are reloaded by refreshCertificates.
+func (cfg *config) watchFiles() (files []string) {
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			files = append(files, name)
+		}
+	}
+	for _, src := range cfg.sources {
+		add(src.file)
+	}
+	for _, pattern := range cfg.includeGlobs {
+		matches, _ := filepath.Glob(pattern)
+		for _, name := range matches {
+			add(name)
+		}
+	}
+	sort.Strings(files)
+	return
+}
+
+func statFiles(files []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(files))
+	for _, name := range files {
+		if fi, err := os.Stat(name); err == nil {
+			stamps[name] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		} else {
+			stamps[name] = fileStamp{}
+		}
+	}
+	return stamps
+}
+
+func sameStamps(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, stamp := range a {
+		if other, ok := b[name]; !ok || !other.modTime.Equal(stamp.modTime) || other.size != stamp.size {
+			return false
+		}
+	}
+	return true
+}
+
+// cfgWatcher polls the files a config was built from and signals Changed
+// once they have stopped changing for the debounce delay.
+type cfgWatcher struct {
+	interval time.Duration
+	debounce time.Duration
+	mu       sync.Mutex
+	cfg      *config
+	last     map[string]fileStamp
+	Changed  chan bool
+	closing  chan bool
+}
+
+func (w *cfgWatcher) Update(cfg *config) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cfg = cfg
+	w.last = statFiles(cfg.watchFiles())
+}
+
+func (w *cfgWatcher) changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	cur := statFiles(w.cfg.watchFiles())
+	if sameStamps(cur, w.last) {
+		return false
+	}
+	w.last = cur
+	return true
+}
+
+func (w *cfgWatcher) Watch() {
+	log.Printf("Watching config: interval=%s debounce=%s", w.interval, w.debounce)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	var changedAt time.Time
+	for {
+		select {
+		case <-ticker.C:
+			if w.changed() {
+				changedAt = time.Now()
+				continue
+			}
+			if !changedAt.IsZero() && time.Since(changedAt) >= w.debounce {
+				changedAt = time.Time{}
+				select {
+				case w.Changed <- true:
+				default:
+				}
+			}
+		case <-w.closing:
+			return
+		}
+	}
+}
+
+func (w *cfgWatcher) Close() {
+	close(w.closing)
+}
+
+func newCfgWatcher(cfg *config, interval, debounce time.Duration) (w *cfgWatcher) {
+	w = &cfgWatcher{
+		interval: interval,
+		debounce: debounce,
+		Changed:  make(chan bool, 1),
+		closing:  make(chan bool),
+	}
+	w.Update(cfg)
+	return
+}
@@ -3,7 +3,8 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
+	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -11,10 +12,11 @@ import (
 type cfgProxyOpts struct {
 	Server  string `yaml:"proxy_server"`
 	Pattern string `yaml:"proxy_pattern"`
+	Cache   string `yaml:"proxy_cache"`
 }
 
 func (cfg *cfgProxyOpts) String() string {
-	return fmt.Sprintf("{ server: %s, pattern: %s }", cfg.Server, cfg.Pattern)
+	return fmt.Sprintf("{ server: %s, pattern: %s, cache: %s }", cfg.Server, cfg.Pattern, cfg.Cache)
 }
 
 type cfgProxyOptsList []*cfgProxyOpts
@@ -48,15 +50,21 @@ func (cfg cfgProxyOptsList) String() string {
 }
 
 type cfgFCgiOpts struct {
-	Server  string            `yaml:"fcgi_server"`
-	Pattern string            `yaml:"fcgi_pattern"`
-	Script  string            `yaml:"fcgi_script"`
-	Index   string            `yaml:"fcgi_index"`
-	Params  map[string]string `yaml:"fcgi_params"`
+	Server    string            `yaml:"fcgi_server"`
+	Pattern   string            `yaml:"fcgi_pattern"`
+	Script    string            `yaml:"fcgi_script"`
+	Index     string            `yaml:"fcgi_index"`
+	Params    map[string]string `yaml:"fcgi_params"`
+	Cache     string            `yaml:"fcgi_cache"`
+	SplitPath string            `yaml:"fcgi_split_path"`
 }
 
 func (cfg *cfgFCgiOpts) String() string {
-	return fmt.Sprintf("{ server: %s, pattern: %s, script: %s, params: %+v }", cfg.Server, cfg.Pattern, cfg.Script, cfg.Params)
+	params := make(map[string]string, len(cfg.Params))
+	for k, v := range cfg.Params {
+		params[k] = redact(v)
+	}
+	return fmt.Sprintf("{ server: %s, pattern: %s, script: %s, params: %+v, cache: %s, splitPath: %s }", cfg.Server, cfg.Pattern, cfg.Script, params, cfg.Cache, cfg.SplitPath)
 }
 
 type cfgFCgiOptsList []*cfgFCgiOpts
@@ -94,21 +102,199 @@ type cfgSslOpts struct {
 	KeyPass string `yaml:"ssl_key_pass"`
 	Cert    string `yaml:"ssl_cert"`
 	Chain   string `yaml:"ssl_chain"`
+	Default bool   `yaml:"ssl_default"`
+	Acme    bool   `yaml:"ssl_acme"`
 }
 
 func (cfg *cfgSslOpts) String() string {
-	return fmt.Sprintf("{ key: %s, keyPass: %s, cert: %s, chain: %s }", cfg.Key, cfg.KeyPass, cfg.Cert, cfg.Chain)
+	return fmt.Sprintf("{ key: %s, keyPass: %s, cert: %s, chain: %s, default: %t, acme: %t }", cfg.Key, redact(cfg.KeyPass), cfg.Cert, cfg.Chain, cfg.Default, cfg.Acme)
+}
+
+type cfgAcmeOpts struct {
+	Email        string        `yaml:"email"`
+	Dir          string        `yaml:"dir"`
+	DirectoryUrl string        `yaml:"directory_url"`
+	CaCert       string        `yaml:"ca_cert"`
+	RenewBefore  time.Duration `yaml:"renew_before"`
+}
+
+func newAcmeOpts() *cfgAcmeOpts {
+	return &cfgAcmeOpts{
+		Dir:          "acme",
+		DirectoryUrl: defaultAcmeDirectory,
+		RenewBefore:  30 * 24 * time.Hour,
+	}
+}
+
+func (cfg *cfgAcmeOpts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*cfg = *newAcmeOpts()
+	type plain cfgAcmeOpts
+	return unmarshal((*plain)(cfg))
+}
+
+func (cfg *cfgAcmeOpts) String() string {
+	return fmt.Sprintf("{ email: %s, dir: %s, directoryUrl: %s, caCert: %s, renewBefore: %s }", cfg.Email, cfg.Dir, cfg.DirectoryUrl, cfg.CaCert, cfg.RenewBefore)
+}
+
+type cfgAccessLog struct {
+	File     string `yaml:"file"`
+	Format   string `yaml:"format"`
+	Template string `yaml:"template"`
+}
+
+func (cfg *cfgAccessLog) String() string {
+	return fmt.Sprintf("{ file: %s, format: %s, template: %q }", cfg.File, cfg.Format, cfg.Template)
+}
+
+type cfgStaticOpts struct {
+	Autoindex  bool     `yaml:"autoindex"`
+	Index      []string `yaml:"index"`
+	DenyHidden bool     `yaml:"deny_hidden"`
+	TryFiles   []string `yaml:"try_files"`
+}
+
+func newStaticOpts() *cfgStaticOpts {
+	return &cfgStaticOpts{
+		Autoindex:  true,
+		Index:      []string{"index.html"},
+		DenyHidden: true,
+	}
+}
+
+func (cfg *cfgStaticOpts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*cfg = *newStaticOpts()
+	type plain cfgStaticOpts
+	return unmarshal((*plain)(cfg))
+}
+
+func (cfg *cfgStaticOpts) String() string {
+	return fmt.Sprintf("{ autoindex: %t, index: %v, denyHidden: %t, tryFiles: %v }", cfg.Autoindex, cfg.Index, cfg.DenyHidden, cfg.TryFiles)
+}
+
+type cfgCompressOpts struct {
+	Encodings     []string `yaml:"encodings"`
+	Types         []string `yaml:"types"`
+	MinSize       int      `yaml:"min_size"`
+	Precompressed bool     `yaml:"precompressed"`
+}
+
+func newCompressOpts() *cfgCompressOpts {
+	return &cfgCompressOpts{
+		Encodings: []string{compressBrotli, compressZstd, compressGzip},
+		Types: []string{
+			"text/*",
+			"application/javascript",
+			"application/json",
+			"application/xml",
+			"application/rss+xml",
+			"application/atom+xml",
+			"application/wasm",
+			"image/svg+xml",
+		},
+		MinSize:       1024,
+		Precompressed: true,
+	}
+}
+
+func (cfg *cfgCompressOpts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*cfg = *newCompressOpts()
+	type plain cfgCompressOpts
+	return unmarshal((*plain)(cfg))
+}
+
+func (cfg *cfgCompressOpts) String() string {
+	return fmt.Sprintf("{ encodings: %v, types: %v, minSize: %d, precompressed: %t }", cfg.Encodings, cfg.Types, cfg.MinSize, cfg.Precompressed)
+}
+
+type cfgHttp2Opts struct {
+	Enabled              bool          `yaml:"enabled"`
+	H2c                  bool          `yaml:"h2c"`
+	MaxConcurrentStreams uint32        `yaml:"max_concurrent_streams"`
+	MaxReadFrameSize     uint32        `yaml:"max_read_frame_size"`
+	ConnWindowSize       int32         `yaml:"conn_window_size"`
+	StreamWindowSize     int32         `yaml:"stream_window_size"`
+	IdleTimeout          time.Duration `yaml:"idle_timeout"`
+}
+
+func newHttp2Opts() *cfgHttp2Opts {
+	return &cfgHttp2Opts{
+		Enabled:              true,
+		H2c:                  false,
+		MaxConcurrentStreams: 250,
+		MaxReadFrameSize:     1 << 20,
+		ConnWindowSize:       1 << 20,
+		StreamWindowSize:     1 << 20,
+		IdleTimeout:          0,
+	}
+}
+
+func (cfg *cfgHttp2Opts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*cfg = *newHttp2Opts()
+	type plain cfgHttp2Opts
+	return unmarshal((*plain)(cfg))
+}
+
+func (cfg *cfgHttp2Opts) String() string {
+	return fmt.Sprintf("{ enabled: %t, h2c: %t, maxConcurrentStreams: %d, maxReadFrameSize: %d, connWindowSize: %d, streamWindowSize: %d, idleTimeout: %s }", cfg.Enabled, cfg.H2c, cfg.MaxConcurrentStreams, cfg.MaxReadFrameSize, cfg.ConnWindowSize, cfg.StreamWindowSize, cfg.IdleTimeout)
+}
+
+type cfgHttp3Opts struct {
+	Enabled              bool          `yaml:"enabled"`
+	MaxAge               time.Duration `yaml:"max_age"`
+	MaxConcurrentStreams int64         `yaml:"max_concurrent_streams"`
+	IdleTimeout          time.Duration `yaml:"idle_timeout"`
+}
+
+func newHttp3Opts() *cfgHttp3Opts {
+	return &cfgHttp3Opts{
+		Enabled:              false,
+		MaxAge:               24 * time.Hour,
+		MaxConcurrentStreams: 100,
+		IdleTimeout:          30 * time.Second,
+	}
+}
+
+func (cfg *cfgHttp3Opts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*cfg = *newHttp3Opts()
+	type plain cfgHttp3Opts
+	return unmarshal((*plain)(cfg))
+}
+
+func (cfg *cfgHttp3Opts) String() string {
+	return fmt.Sprintf("{ enabled: %t, maxAge: %s, maxConcurrentStreams: %d, idleTimeout: %s }", cfg.Enabled, cfg.MaxAge, cfg.MaxConcurrentStreams, cfg.IdleTimeout)
 }
 
 type cfgSite struct {
-	Host    string           `yaml:"site_host"`
-	Ip      string           `yaml:"site_ip"`
-	Port    string           `yaml:"site_port"`
-	Root    string           `yaml:"site_root"`
-	SslOn   bool             `yaml:"site_ssl_on"`
-	SslOpts *cfgSslOpts      `yaml:"site_ssl_opts"`
-	FCgi    cfgFCgiOptsList  `yaml:"site_fcgi"`
-	Proxy   cfgProxyOptsList `yaml:"site_proxy"`
+	Host            string           `yaml:"site_host"`
+	Ip              string           `yaml:"site_ip"`
+	Port            string           `yaml:"site_port"`
+	Root            string           `yaml:"site_root"`
+	SslOn           bool             `yaml:"site_ssl_on"`
+	SslOpts         *cfgSslOpts      `yaml:"site_ssl_opts"`
+	FCgi            cfgFCgiOptsList  `yaml:"site_fcgi"`
+	Proxy           cfgProxyOptsList `yaml:"site_proxy"`
+	MaxResponseSize int64            `yaml:"site_max_response_size"`
+	MaxBodySize     int64            `yaml:"site_max_body_size"`
+	BodyBufferSize  int64            `yaml:"site_body_buffer_size"`
+	AccessLog       *cfgAccessLog    `yaml:"site_access_log"`
+	Static          *cfgStaticOpts   `yaml:"site_static"`
+	Compress        *cfgCompressOpts `yaml:"site_compress"`
+	Http2           *cfgHttp2Opts    `yaml:"site_http2"`
+	Http3           *cfgHttp3Opts    `yaml:"site_http3"`
+}
+
+func (cfg *cfgSite) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain cfgSite
+	if err := unmarshal((*plain)(cfg)); err != nil {
+		return err
+	}
+	if cfg.Http2 == nil {
+		cfg.Http2 = newHttp2Opts()
+	}
+	if cfg.Http3 == nil {
+		cfg.Http3 = newHttp3Opts()
+	}
+	return nil
 }
 
 func (cfg *cfgSite) Addr() string {
@@ -116,7 +302,7 @@ func (cfg *cfgSite) Addr() string {
 }
 
 func (cfg *cfgSite) String() string {
-	return fmt.Sprintf("{ host: %s, ip: %s, port: %s, root: %s, sslOn: %t, sslOpts: %s, fcgi: %s, proxy: %s }", cfg.Host, cfg.Ip, cfg.Port, cfg.Root, cfg.SslOn, cfg.SslOpts, cfg.FCgi, cfg.Proxy)
+	return fmt.Sprintf("{ host: %s, ip: %s, port: %s, root: %s, sslOn: %t, sslOpts: %s, fcgi: %s, proxy: %s, maxResponseSize: %d, maxBodySize: %d, bodyBufferSize: %d, accessLog: %s, static: %s, compress: %s, http2: %s, http3: %s }", cfg.Host, cfg.Ip, cfg.Port, cfg.Root, cfg.SslOn, cfg.SslOpts, cfg.FCgi, cfg.Proxy, cfg.MaxResponseSize, cfg.MaxBodySize, cfg.BodyBufferSize, cfg.AccessLog, cfg.Static, cfg.Compress, cfg.Http2, cfg.Http3)
 }
 
 type cfgSiteList []*cfgSite
@@ -165,9 +351,9 @@ func (cfg cfgServerList) String() string {
 	ret := ""
 	cfg.Each(func(idx int, server string) bool {
 		if idx == 0 {
-			ret = fmt.Sprintf("[ %s", server)
+			ret = fmt.Sprintf("[ %s", redactUrl(server))
 		} else {
-			ret = fmt.Sprintf("%s,  %s", ret, server)
+			ret = fmt.Sprintf("%s,  %s", ret, redactUrl(server))
 		}
 		return true
 	})
@@ -179,18 +365,141 @@ func (cfg cfgServerList) String() string {
 	return ret
 }
 
-type cfgServerMap map[string]cfgServerList
+type cfgPoolOpts struct {
+	MinIdle        int           `yaml:"min_idle"`
+	MaxIdle        int           `yaml:"max_idle"`
+	MaxConns       int           `yaml:"max_conns"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	MaxRequests    int           `yaml:"max_requests"`
+	KeepConn       bool          `yaml:"keep_conn"`
+	Multiplex      bool          `yaml:"multiplex"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	WriteTimeout   time.Duration `yaml:"write_timeout"`
+}
+
+func newPoolOpts() *cfgPoolOpts {
+	return &cfgPoolOpts{
+		MinIdle:        0,
+		MaxIdle:        8,
+		MaxConns:       0,
+		IdleTimeout:    60 * time.Second,
+		MaxRequests:    0,
+		KeepConn:       true,
+		Multiplex:      false,
+		ConnectTimeout: 5 * time.Second,
+		ReadTimeout:    60 * time.Second,
+		WriteTimeout:   60 * time.Second,
+	}
+}
+
+func (cfg *cfgPoolOpts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*cfg = *newPoolOpts()
+	type plain cfgPoolOpts
+	return unmarshal((*plain)(cfg))
+}
+
+func (cfg *cfgPoolOpts) String() string {
+	return fmt.Sprintf("{ minIdle: %d, maxIdle: %d, maxConns: %d, idleTimeout: %s, maxRequests: %d, keepConn: %t, multiplex: %t, connectTimeout: %s, readTimeout: %s, writeTimeout: %s }", cfg.MinIdle, cfg.MaxIdle, cfg.MaxConns, cfg.IdleTimeout, cfg.MaxRequests, cfg.KeepConn, cfg.Multiplex, cfg.ConnectTimeout, cfg.ReadTimeout, cfg.WriteTimeout)
+}
 
-func (cfg cfgServerMap) Each(cb func(label string, lst cfgServerList) bool) {
+type cfgHealthOpts struct {
+	Interval     time.Duration `yaml:"interval"`
+	Timeout      time.Duration `yaml:"timeout"`
+	Path         string        `yaml:"path"`
+	ExpectStatus int           `yaml:"expect_status"`
+	ExpectBody   string        `yaml:"expect_body"`
+	MaxFails     int           `yaml:"max_fails"`
+	Rises        int           `yaml:"rises"`
+	Backoff      time.Duration `yaml:"backoff"`
+	MaxBackoff   time.Duration `yaml:"max_backoff"`
+}
+
+func newHealthOpts() *cfgHealthOpts {
+	return &cfgHealthOpts{
+		Interval:   10 * time.Second,
+		Timeout:    2 * time.Second,
+		MaxFails:   3,
+		Rises:      2,
+		Backoff:    5 * time.Second,
+		MaxBackoff: 2 * time.Minute,
+	}
+}
+
+func (cfg *cfgHealthOpts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*cfg = *newHealthOpts()
+	type plain cfgHealthOpts
+	if err := unmarshal((*plain)(cfg)); err != nil {
+		return err
+	}
+	if cfg.MaxFails < 1 {
+		cfg.MaxFails = 1
+	}
+	if cfg.Rises < 1 {
+		cfg.Rises = 1
+	}
+	return nil
+}
+
+func (cfg *cfgHealthOpts) String() string {
+	return fmt.Sprintf("{ interval: %s, timeout: %s, path: %s, expectStatus: %d, expectBody: %s, maxFails: %d, rises: %d, backoff: %s, maxBackoff: %s }", cfg.Interval, cfg.Timeout, cfg.Path, cfg.ExpectStatus, cfg.ExpectBody, cfg.MaxFails, cfg.Rises, cfg.Backoff, cfg.MaxBackoff)
+}
+
+type cfgServerGroup struct {
+	Servers   cfgServerList  `yaml:"servers"`
+	Weights   map[string]int `yaml:"weights"`
+	LbPolicy  string         `yaml:"lb_policy"`
+	LbHashKey string         `yaml:"lb_hash_key"`
+	Pool      *cfgPoolOpts   `yaml:"pool"`
+	Health    *cfgHealthOpts `yaml:"health"`
+}
+
+func (cfg *cfgServerGroup) Weight(server string) int {
+	if w, ok := cfg.Weights[server]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+func (cfg *cfgServerGroup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var lst cfgServerList
+	if err := unmarshal(&lst); err == nil {
+		cfg.Servers = lst
+	} else {
+		type plain cfgServerGroup
+		if err := unmarshal((*plain)(cfg)); err != nil {
+			return err
+		}
+	}
+	if cfg.Pool == nil {
+		cfg.Pool = newPoolOpts()
+	}
+	if cfg.Health == nil {
+		cfg.Health = newHealthOpts()
+	}
+	return nil
+}
+
+func (cfg *cfgServerGroup) String() string {
+	weights := make(map[string]int, len(cfg.Weights))
+	for server, w := range cfg.Weights {
+		weights[redactUrl(server)] = w
+	}
+	return fmt.Sprintf("{ servers: %s, weights: %+v, lbPolicy: %s, lbHashKey: %s, pool: %s, health: %s }", cfg.Servers, weights, cfg.LbPolicy, cfg.LbHashKey, cfg.Pool, cfg.Health)
+}
+
+type cfgServerMap map[string]*cfgServerGroup
+
+func (cfg cfgServerMap) Each(cb func(label string, grp *cfgServerGroup) bool) {
 	if cfg != nil {
-		for label, lst := range cfg {
-			if !cb(label, lst) {
+		for label, grp := range cfg {
+			if !cb(label, grp) {
 				break
 			}
 		}
 	}
 }
-func (cfg cfgServerMap) Get(n string) (val cfgServerList, ok bool) {
+func (cfg cfgServerMap) Get(n string) (val *cfgServerGroup, ok bool) {
 	if cfg != nil {
 		val, ok = cfg[n]
 	}
@@ -199,11 +508,78 @@ func (cfg cfgServerMap) Get(n string) (val cfgServerList, ok bool) {
 
 func (cfg cfgServerMap) String() string {
 	ret := ""
-	cfg.Each(func(label string, lst cfgServerList) bool {
+	cfg.Each(func(label string, grp *cfgServerGroup) bool {
+		if ret == "" {
+			ret = fmt.Sprintf("[ %s: %s", label, grp)
+		} else {
+			ret = fmt.Sprintf("%s, %s: %s", ret, label, grp)
+		}
+		return true
+	})
+	if ret == "" {
+		ret = "{}"
+	} else {
+		ret = fmt.Sprintf("%s }", ret)
+	}
+	return ret
+}
+
+type cfgCacheOpts struct {
+	Store                string        `yaml:"store"`
+	Dir                  string        `yaml:"dir"`
+	MaxSize              int64         `yaml:"max_size"`
+	MaxEntrySize         int64         `yaml:"max_entry_size"`
+	Key                  string        `yaml:"key"`
+	DefaultTtl           time.Duration `yaml:"default_ttl"`
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate"`
+	StaleIfError         time.Duration `yaml:"stale_if_error"`
+	PurgeAllow           []string      `yaml:"purge_allow"`
+}
+
+func newCacheOpts() *cfgCacheOpts {
+	return &cfgCacheOpts{
+		Store:        cacheMemory,
+		MaxSize:      64 << 20,
+		MaxEntrySize: 1 << 20,
+		Key:          "$scheme$host$request_uri",
+		PurgeAllow:   []string{"127.0.0.1", "::1"},
+	}
+}
+
+func (cfg *cfgCacheOpts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*cfg = *newCacheOpts()
+	type plain cfgCacheOpts
+	return unmarshal((*plain)(cfg))
+}
+
+func (cfg *cfgCacheOpts) String() string {
+	return fmt.Sprintf("{ store: %s, dir: %s, maxSize: %d, maxEntrySize: %d, key: %s, defaultTtl: %s, staleWhileRevalidate: %s, staleIfError: %s, purgeAllow: %v }", cfg.Store, cfg.Dir, cfg.MaxSize, cfg.MaxEntrySize, cfg.Key, cfg.DefaultTtl, cfg.StaleWhileRevalidate, cfg.StaleIfError, cfg.PurgeAllow)
+}
+
+type cfgCacheMap map[string]*cfgCacheOpts
+
+func (cfg cfgCacheMap) Each(cb func(name string, cacheOpts *cfgCacheOpts) bool) {
+	if cfg != nil {
+		for name, cacheOpts := range cfg {
+			if !cb(name, cacheOpts) {
+				break
+			}
+		}
+	}
+}
+
+func (cfg cfgCacheMap) Get(name string) (cacheOpts *cfgCacheOpts, ok bool) {
+	cacheOpts, ok = cfg[name]
+	return
+}
+
+func (cfg cfgCacheMap) String() string {
+	ret := ""
+	cfg.Each(func(name string, cacheOpts *cfgCacheOpts) bool {
 		if ret == "" {
-			ret = fmt.Sprintf("[ %s: %s", label, lst)
+			ret = fmt.Sprintf("{ %s: %s", name, cacheOpts)
 		} else {
-			ret = fmt.Sprintf("%s, %s: %s", ret, label, lst)
+			ret = fmt.Sprintf("%s, %s: %s", ret, name, cacheOpts)
 		}
 		return true
 	})
@@ -215,28 +591,76 @@ func (cfg cfgServerMap) String() string {
 	return ret
 }
 
+type cfgMetrics struct {
+	Listen string `yaml:"listen"`
+	Path   string `yaml:"path"`
+}
+
+func (cfg *cfgMetrics) String() string {
+	return fmt.Sprintf("{ listen: %s, path: %s }", cfg.Listen, cfg.Path)
+}
+
 type config struct {
-	Sites        cfgSiteList  `yaml:"sites"`
-	FCgiServers  cfgServerMap `yaml:"fcgi"`
-	ProxyServers cfgServerMap `yaml:"proxy"`
-	Live         bool         `yaml:"live"`
+	Sites           cfgSiteList   `yaml:"sites"`
+	FCgiServers     cfgServerMap  `yaml:"fcgi"`
+	ProxyServers    cfgServerMap  `yaml:"proxy"`
+	Live            bool          `yaml:"live"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	AccessLog       *cfgAccessLog `yaml:"access_log"`
+	Metrics         *cfgMetrics   `yaml:"metrics"`
+	Caches          cfgCacheMap   `yaml:"cache"`
+	Acme            *cfgAcmeOpts  `yaml:"acme"`
+
+	Include []string `yaml:"include"`
+
+	sources      []*cfgSource
+	includeGlobs []string
+	siteOrigins  []*cfgOrigin
+	fCgiOrigins  map[string]*cfgSource
+	proxyOrigins map[string]*cfgSource
 }
 
 func (cfg *config) String() string {
-	return fmt.Sprintf("{ sites: %s, fcgi_servers: %+v, proxy_servers: %+v, live: %t }", cfg.Sites, cfg.FCgiServers, cfg.ProxyServers, cfg.Live)
+	return fmt.Sprintf("{ sites: %s, fcgi_servers: %+v, proxy_servers: %+v, live: %t, shutdown_timeout: %s, access_log: %s, metrics: %s, cache: %s, acme: %s }", cfg.Sites, cfg.FCgiServers, cfg.ProxyServers, cfg.Live, cfg.ShutdownTimeout, cfg.AccessLog, cfg.Metrics, cfg.Caches, cfg.Acme)
 }
 
-func loadConfig() (cfg *config) {
-	file, e := ioutil.ReadFile("config.yml")
-	if e != nil {
-		log.Fatalf("Config file error: %v\n", e)
+func loadConfig(path string) (cfg *config, err error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
 	}
-	var err error
 
-	cfg = new(config)
-	err = yaml.Unmarshal(file, cfg)
-	if err != nil {
-		log.Fatalf("Config file error: %v\n", err)
+	cfg = &config{
+		ShutdownTimeout: 30 * time.Second,
+		fCgiOrigins:     make(map[string]*cfgSource),
+		proxyOrigins:    make(map[string]*cfgSource),
+	}
+	if err = yaml.Unmarshal(file, cfg); err != nil {
+		return nil, err
+	}
+	src := &cfgSource{file: path, source: file}
+	cfg.sources = []*cfgSource{src}
+	for idx := range cfg.Sites {
+		cfg.siteOrigins = append(cfg.siteOrigins, &cfgOrigin{src: src, idx: idx})
+	}
+	for label := range cfg.FCgiServers {
+		cfg.fCgiOrigins[label] = src
+	}
+	for label := range cfg.ProxyServers {
+		cfg.proxyOrigins[label] = src
+	}
+	abs, _ := filepath.Abs(path)
+	if err = cfg.loadIncludes(cfg.Include, path, map[string]bool{abs: true}); err != nil {
+		return nil, err
+	}
+	if err = cfg.Interpolate(); err != nil {
+		return nil, err
+	}
+	if cfg.Metrics != nil && cfg.Metrics.Path == "" {
+		cfg.Metrics.Path = "/metrics"
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, err
 	}
 
 	return
@@ -1,32 +1,419 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-
-	"github.com/tomasen/fcgi_client"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
+const fCgiProbeRetry = time.Minute
+
+type fCgiConnPool struct {
+	server     string
+	opts       *cfgPoolOpts
+	health     *upstreamHealth
+	mu         sync.Mutex
+	conns      []*fCgiConn
+	dialing    int
+	inflight   int
+	caps       *fCgiCaps
+	probing    *fCgiConn
+	probeAfter time.Time
+	freed      chan bool
+	closed     bool
+	closing    chan bool
+}
+
+// probe asks the server for its capacity on the first pooled connection
+// that is idle, so that no request waits for the answer. The connection
+// is not handed out meanwhile, as some servers close it after answering;
+// until a server answers it is taken to have no limits, and another idle
+// connection asks again after fCgiProbeRetry. Called with pool.mu held.
+func (pool *fCgiConnPool) probe(conn *fCgiConn) {
+	if pool.caps != nil || pool.probing != nil || time.Now().Before(pool.probeAfter) {
+		return
+	}
+	pool.probing = conn
+	timeout := pool.opts.ConnectTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	go func() {
+		var caps *fCgiCaps
+		query := map[string]string{fCgiMaxConns: "", fCgiMaxReqs: "", fCgiMpxsConns: ""}
+		err := conn.writeRecord(fCgiGetValues, 0, encodeFcgiParams(query))
+		if err == nil {
+			select {
+			case caps = <-conn.values:
+			case <-time.After(timeout):
+				err = errors.New("no answer")
+			}
+		}
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		pool.probing = nil
+		if err != nil {
+			log.Printf("FCgi values unavailable: server=%s err=%v", pool.server, err)
+			pool.probeAfter = time.Now().Add(fCgiProbeRetry)
+			pool.signal()
+			return
+		}
+		log.Printf("FCgi values: server=%s values=%s", pool.server, caps)
+		pool.caps = caps
+		for _, c := range pool.conns {
+			c.mpx = pool.opts.Multiplex && c.keepConn && caps.Mpxs
+		}
+		pool.signal()
+	}()
+}
+
+func (pool *fCgiConnPool) dial() (conn *fCgiConn, err error) {
+	if conn, err = dialFcgi(pool.server, pool.opts.KeepConn, pool.opts.ConnectTimeout); err != nil {
+		return
+	}
+	pool.mu.Lock()
+	conn.mpx = pool.opts.Multiplex && pool.opts.KeepConn && pool.caps != nil && pool.caps.Mpxs
+	pool.mu.Unlock()
+	conn.pool = pool
+	conn.readTimeout = pool.opts.ReadTimeout
+	conn.writeTimeout = pool.opts.WriteTimeout
+	go conn.readLoop()
+	return
+}
+
+func (pool *fCgiConnPool) maxConns() int {
+	max := pool.opts.MaxConns
+	if pool.caps != nil && pool.caps.MaxConns > 0 && (max == 0 || pool.caps.MaxConns < max) {
+		max = pool.caps.MaxConns
+	}
+	return max
+}
+
+func (pool *fCgiConnPool) expired(conn *fCgiConn) bool {
+	if conn.Broken() {
+		return true
+	}
+	if pool.opts.MaxRequests > 0 && conn.requests >= pool.opts.MaxRequests {
+		return true
+	}
+	if conn.active == 0 && pool.opts.IdleTimeout > 0 && time.Since(conn.lastUsed) > pool.opts.IdleTimeout {
+		return true
+	}
+	return false
+}
+
+func (pool *fCgiConnPool) idle() (n int) {
+	for _, conn := range pool.conns {
+		if conn.active == 0 {
+			n++
+		}
+	}
+	return
+}
+
+func (pool *fCgiConnPool) remove(conn *fCgiConn) {
+	for i, c := range pool.conns {
+		if c == conn {
+			pool.conns = append(pool.conns[:i], pool.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// prune closes the idle connections that expired.
+func (pool *fCgiConnPool) prune() {
+	conns := pool.conns[:0]
+	for _, conn := range pool.conns {
+		if conn.active == 0 && pool.expired(conn) {
+			conn.Close()
+		} else {
+			conns = append(conns, conn)
+		}
+	}
+	pool.conns = conns
+}
+
+// signal wakes up the requests waiting for a connection.
+func (pool *fCgiConnPool) signal() {
+	close(pool.freed)
+	pool.freed = make(chan bool)
+}
+
+// reserve takes a connection for a request: the most recently used idle
+// one, or the least busy one when the server multiplexes. It asks for a
+// new connection to be dialed when there is none and the server's limits
+// allow it.
+func (pool *fCgiConnPool) reserve() (conn *fCgiConn, dial bool) {
+	if pool.caps != nil && pool.caps.MaxReqs > 0 && pool.inflight >= pool.caps.MaxReqs {
+		return nil, false
+	}
+	pool.prune()
+	for i := len(pool.conns) - 1; i >= 0; i-- {
+		c := pool.conns[i]
+		if (c.active > 0 && !c.mpx) || c == pool.probing || pool.expired(c) {
+			continue
+		}
+		if conn == nil || c.active < conn.active {
+			conn = c
+		}
+	}
+	if conn != nil {
+		conn.active++
+		conn.requests++
+		pool.inflight++
+		return conn, false
+	}
+	if max := pool.maxConns(); max > 0 && len(pool.conns)+pool.dialing >= max {
+		return nil, false
+	}
+	pool.dialing++
+	pool.inflight++
+	return nil, true
+}
+
+func (pool *fCgiConnPool) open() (conn *fCgiConn, err error) {
+	conn, err = pool.dial()
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.dialing--
+	if err != nil {
+		pool.inflight--
+		pool.signal()
+		return nil, err
+	}
+	conn.active = 1
+	conn.requests = 1
+	pool.conns = append(pool.conns, conn)
+	return
+}
+
+// Get returns a connection for one request, waiting for one to be
+// released while the server is at its FCGI_MAX_CONNS or FCGI_MAX_REQS.
+func (pool *fCgiConnPool) Get(ctx context.Context) (*fCgiConn, error) {
+	for {
+		pool.mu.Lock()
+		if pool.closed {
+			pool.mu.Unlock()
+			return nil, errFcgiUnavailable
+		}
+		conn, dial := pool.reserve()
+		freed := pool.freed
+		pool.mu.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		if dial {
+			return pool.open()
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pool.closing:
+			return nil, errFcgiUnavailable
+		}
+	}
+}
+
+func (pool *fCgiConnPool) Put(conn *fCgiConn) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	conn.active--
+	pool.inflight--
+	conn.lastUsed = time.Now()
+	pool.signal()
+	if conn.active > 0 {
+		return
+	}
+	pool.remove(conn)
+	if pool.closed || !conn.keepConn || pool.expired(conn) || pool.idle() >= pool.opts.MaxIdle {
+		conn.Close()
+		return
+	}
+	pool.conns = append(pool.conns, conn)
+	pool.probe(conn)
+}
+
+func (pool *fCgiConnPool) maintain() {
+	interval := pool.opts.IdleTimeout / 2
+	if interval <= 0 || interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		pool.fill()
+		select {
+		case <-ticker.C:
+			pool.mu.Lock()
+			pool.prune()
+			pool.mu.Unlock()
+		case <-pool.closing:
+			return
+		}
+	}
+}
+
+func (pool *fCgiConnPool) fill() {
+	if !pool.opts.KeepConn {
+		return
+	}
+	for {
+		pool.mu.Lock()
+		n := pool.idle() + pool.dialing
+		max := pool.maxConns()
+		full := max > 0 && len(pool.conns)+pool.dialing >= max
+		pool.mu.Unlock()
+		if n >= pool.opts.MinIdle || n >= pool.opts.MaxIdle || full {
+			return
+		}
+		if !pool.health.Healthy() {
+			return
+		}
+		conn, err := pool.dial()
+		if err != nil {
+			log.Printf("FCgi pool error: server=%s err=%v", pool.server, err)
+			pool.health.Failure(err)
+			return
+		}
+		pool.mu.Lock()
+		if pool.closed {
+			conn.Close()
+		} else {
+			conn.lastUsed = time.Now()
+			pool.conns = append(pool.conns, conn)
+			pool.probe(conn)
+			pool.signal()
+		}
+		pool.mu.Unlock()
+	}
+}
+
+func (pool *fCgiConnPool) Close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if pool.closed {
+		return
+	}
+	pool.closed = true
+	close(pool.closing)
+	pool.health.Close()
+	conns := pool.conns[:0]
+	for _, conn := range pool.conns {
+		if conn.active == 0 {
+			conn.Close()
+		} else {
+			conns = append(conns, conn)
+		}
+	}
+	pool.conns = conns
+}
+
+func (pool *fCgiConnPool) ping(opts *cfgHealthOpts) error {
+	conn, err := dialFcgi(pool.server, false, opts.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if opts.Path == "" {
+		return nil
+	}
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+		conn.readTimeout = opts.Timeout
+		conn.writeTimeout = opts.Timeout
+	}
+	go conn.readLoop()
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "goweb/1.0",
+		"REQUEST_METHOD":    "GET",
+		"SCRIPT_NAME":       opts.Path,
+		"SCRIPT_FILENAME":   opts.Path,
+		"REQUEST_URI":       opts.Path,
+	}
+	resp, err := conn.Request(ctx, params, nil)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ping status %d", resp.StatusCode)
+	}
+	if opts.ExpectBody != "" && !strings.Contains(string(body), opts.ExpectBody) {
+		return fmt.Errorf("ping body %q", strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func newFcgiConnPool(name, server string, opts *cfgPoolOpts, healthOpts *cfgHealthOpts) (pool *fCgiConnPool) {
+	pool = &fCgiConnPool{
+		server:  server,
+		opts:    opts,
+		freed:   make(chan bool),
+		closing: make(chan bool),
+	}
+	pool.health = newUpstreamHealth("fcgi", name, server, healthOpts, func() error {
+		return pool.ping(healthOpts)
+	})
+	go pool.maintain()
+	return
+}
+
 type fCgiClientJob struct {
-	process func(fcgi *fcgiclient.FCGIClient, err error)
+	req     *http.Request
+	process func(fcgi *fCgiConn, err error)
 }
 
-func (job *fCgiClientJob) Run(fcgi *fcgiclient.FCGIClient, err error) {
+func (job *fCgiClientJob) Run(fcgi *fCgiConn, err error) {
 	job.process(fcgi, err)
 }
 
+var errFcgiUnavailable = errors.New("No fast cgi available")
+
 type fCgiClients struct {
-	name     string
-	servers  cfgServerList
-	workerCh chan *fCgiClientJob
-	closing  chan bool
+	name       string
+	servers    cfgServerList
+	poolOpts   *cfgPoolOpts
+	healthOpts *cfgHealthOpts
+	pools      []*fCgiConnPool
+	balancer   *upstreamBalancer
+	workerCh   chan *fCgiClientJob
+	closing    chan bool
 }
 
-func (fcgi *fCgiClients) Start(server string, id int) {
+func (fcgi *fCgiClients) Start() {
 	for {
 		select {
 		case job := <-fcgi.workerCh:
+			idx, ok := fcgi.balancer.Pick(job.req)
+			if !ok {
+				go job.Run(nil, errFcgiUnavailable)
+				continue
+			}
+			pool := fcgi.pools[idx]
+			node := fcgi.balancer.nodes[idx]
+			node.Acquire()
 			go func() {
-				client, err := fcgiclient.Dial("tcp", server)
+				defer node.Release()
+				client, err := pool.Get(job.req.Context())
+				if err != nil && job.req.Context().Err() == nil {
+					pool.health.Failure(err)
+				}
 				job.Run(client, err)
 			}()
 		case <-fcgi.closing:
@@ -35,16 +422,30 @@ func (fcgi *fCgiClients) Start(server string, id int) {
 	}
 }
 
-func (fcgi *fCgiClients) Init() {
+func (fcgi *fCgiClients) Available() bool {
+	for _, pool := range fcgi.pools {
+		if pool.health.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+func (fcgi *fCgiClients) Init(grp *cfgServerGroup) {
 	fcgi.servers.Each(func(idx int, server string) bool {
-		log.Printf("Starting FCgi: name=%s server=%s", fcgi.name, server)
-		go fcgi.Start(server, idx)
+		log.Printf("Starting FCgi: name=%s server=%s weight=%d pool=%s health=%s", fcgi.name, server, grp.Weight(server), fcgi.poolOpts, fcgi.healthOpts)
+		pool := newFcgiConnPool(fcgi.name, server, fcgi.poolOpts, fcgi.healthOpts)
+		fcgi.pools = append(fcgi.pools, pool)
+		fcgi.balancer.Add(&upstreamNode{server: server, weight: grp.Weight(server), health: pool.health})
 		return true
 	})
+	log.Printf("Starting FCgi balancer: name=%s lb_policy=%s", fcgi.name, fcgi.balancer.policy)
+	go fcgi.Start()
 }
 func (fcgi *fCgiClients) Kill() {
-	for _, _ = range fcgi.servers {
-		fcgi.closing <- true
+	fcgi.closing <- true
+	for _, pool := range fcgi.pools {
+		pool.Close()
 	}
 }
 
@@ -52,13 +453,16 @@ func (fcgi *fCgiClients) Jobs() chan *fCgiClientJob {
 	return fcgi.workerCh
 }
 
-func newFcgiClient(name string, servers cfgServerList) (fcgi *fCgiClients) {
+func newFcgiClient(name string, grp *cfgServerGroup) (fcgi *fCgiClients) {
 	fcgi = &fCgiClients{
-		name:     name,
-		servers:  servers,
-		workerCh: make(chan *fCgiClientJob, len(servers)*100),
-		closing:  make(chan bool, len(servers)),
+		name:       name,
+		servers:    grp.Servers,
+		poolOpts:   grp.Pool,
+		healthOpts: grp.Health,
+		balancer:   newUpstreamBalancer(name, grp),
+		workerCh:   make(chan *fCgiClientJob, len(grp.Servers)*100),
+		closing:    make(chan bool, 1),
 	}
-	fcgi.Init()
+	fcgi.Init(grp)
 	return
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func splitHostPort(addr string) (host, port string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+	return
+}
+
+// scriptPath splits the request path into SCRIPT_NAME and PATH_INFO with
+// fcgi_split_path, appending fcgi_index to directory requests.
+func (hndlr *fCgiHandler) scriptPath(uri string) (scriptName, pathInfo string) {
+	scriptName = uri
+	if hndlr.splitPath != nil {
+		if m := hndlr.splitPath.FindStringSubmatch(uri); len(m) > 2 {
+			scriptName, pathInfo = m[1], m[2]
+		}
+	}
+	if hndlr.fCfg.Index != "" && strings.HasSuffix(scriptName, "/") {
+		scriptName += hndlr.fCfg.Index
+	}
+	return
+}
+
+// documentRoot is the part of fcgi_script in front of its %s verb, or the
+// site root when the script does not start with it.
+func (hndlr *fCgiHandler) documentRoot() string {
+	if strings.HasSuffix(hndlr.fCfg.Script, "%s") {
+		return strings.TrimSuffix(strings.Replace(strings.TrimSuffix(hndlr.fCfg.Script, "%s"), "%%", "%", -1), "/")
+	}
+	return strings.TrimSuffix(hndlr.site.Root, "/")
+}
+
+// params builds the CGI/1.1 environment (RFC 3875) for req.
+func (hndlr *fCgiHandler) params(req *http.Request) map[string]string {
+	scriptName, pathInfo := hndlr.scriptPath(req.URL.Path)
+	docRoot := hndlr.documentRoot()
+	remoteAddr, remotePort := splitHostPort(req.RemoteAddr)
+	serverAddr, serverPort := splitHostPort(hndlr.laddr)
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		serverAddr, serverPort = splitHostPort(addr.String())
+	}
+	serverName := hndlr.site.Host
+	if serverName == "" {
+		serverName = stripHostPort(req.Host)
+	}
+
+	params := make(map[string]string)
+	params["GATEWAY_INTERFACE"] = "CGI/1.1"
+	params["SERVER_SOFTWARE"] = "goweb/1.0"
+	params["SERVER_NAME"] = serverName
+	params["SERVER_ADDR"] = serverAddr
+	params["SERVER_PORT"] = serverPort
+	params["SERVER_PROTOCOL"] = req.Proto
+	params["REMOTE_ADDR"] = remoteAddr
+	params["REMOTE_PORT"] = remotePort
+	params["REQUEST_METHOD"] = req.Method
+	params["REQUEST_URI"] = req.RequestURI
+	params["QUERY_STRING"] = req.URL.RawQuery
+	params["DOCUMENT_ROOT"] = docRoot
+	params["DOCUMENT_URI"] = scriptName + pathInfo
+	params["SCRIPT_NAME"] = scriptName
+	params["SCRIPT_FILENAME"] = fmt.Sprintf(hndlr.fCfg.Script, scriptName)
+	if pathInfo != "" {
+		params["PATH_INFO"] = pathInfo
+		params["PATH_TRANSLATED"] = docRoot + pathInfo
+	}
+	if req.TLS != nil {
+		params["HTTPS"] = "on"
+		params["REQUEST_SCHEME"] = "https"
+	} else {
+		params["REQUEST_SCHEME"] = "http"
+	}
+	if req.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+	if v := req.Header.Get("Content-Type"); v != "" {
+		params["CONTENT_TYPE"] = v
+	}
+	for k, v := range req.Header {
+		switch k {
+		case "Content-Type", "Content-Length", "Proxy":
+			continue
+		}
+		if len(v) > 0 {
+			sep := ", "
+			if k == "Cookie" {
+				sep = "; "
+			}
+			params["HTTP_"+strings.ToUpper(strings.Replace(k, "-", "_", -1))] = strings.Join(v, sep)
+		}
+	}
+	if _, ok := params["HTTP_HOST"]; !ok {
+		params["HTTP_HOST"] = req.Host
+	}
+	if _, ok := params["HTTP_CONNECTION"]; !ok {
+		params["HTTP_CONNECTION"] = "keep-alive"
+	}
+	if _, ok := params["HTTP_COOKIE"]; !ok {
+		cookies := ""
+		for i, cookie := range req.Cookies() {
+			cookieStr := fmt.Sprintf("%s=%s", sanitizeCookieName(cookie.Name), sanitizeCookieValue(cookie.Value))
+			if i == 0 {
+				cookies = cookieStr
+			} else {
+				cookies = fmt.Sprintf("%s; %s", cookies, cookieStr)
+			}
+		}
+		if cookies != "" {
+			params["HTTP_COOKIE"] = cookies
+		}
+	}
+	params["REQUEST_TIME"] = strconv.Itoa(int(time.Now().Unix()))
+	for k, v := range hndlr.fCfg.Params {
+		params[k] = v
+	}
+	return params
+}
@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fCgiVersion1 uint8 = 1
+
+	fCgiBeginRequest    uint8 = 1
+	fCgiAbortRequest    uint8 = 2
+	fCgiEndRequest      uint8 = 3
+	fCgiParams          uint8 = 4
+	fCgiStdin           uint8 = 5
+	fCgiStdout          uint8 = 6
+	fCgiStderr          uint8 = 7
+	fCgiGetValues       uint8 = 9
+	fCgiGetValuesResult uint8 = 10
+
+	fCgiResponder uint16 = 1
+	fCgiKeepConn  uint8  = 1
+
+	fCgiRequestComplete uint8 = 0
+	fCgiCantMpxConn     uint8 = 1
+	fCgiOverloaded      uint8 = 2
+	fCgiUnknownRole     uint8 = 3
+
+	fCgiMaxConns  = "FCGI_MAX_CONNS"
+	fCgiMaxReqs   = "FCGI_MAX_REQS"
+	fCgiMpxsConns = "FCGI_MPXS_CONNS"
+
+	fCgiMaxWrite    = 65535
+	fCgiMaxBuffered = 1 << 20
+
+	// fCgiAbortTimeout is how long an aborted request may take to end
+	// before its connection is closed.
+	fCgiAbortTimeout = 5 * time.Second
+)
+
+var (
+	errFcgiCantMpxConn = errors.New("fcgi: server cannot multiplex connections")
+	errFcgiOverloaded  = errors.New("fcgi: server overloaded")
+	errFcgiUnknownRole = errors.New("fcgi: server does not support the responder role")
+	errFcgiConnClosed  = errors.New("fcgi: connection closed")
+	errFcgiAborted     = errors.New("fcgi: request aborted")
+)
+
+type fCgiHeader struct {
+	Version       uint8
+	Type          uint8
+	Id            uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// fCgiCaps holds what a server reports through FCGI_GET_VALUES, zero
+// meaning no limit.
+type fCgiCaps struct {
+	MaxConns int
+	MaxReqs  int
+	Mpxs     bool
+}
+
+func (caps *fCgiCaps) String() string {
+	return fmt.Sprintf("{ maxConns: %d, maxReqs: %d, mpxsConns: %t }", caps.MaxConns, caps.MaxReqs, caps.Mpxs)
+}
+
+// fCgiConn is a connection to a FastCGI server. A reader goroutine hands
+// the records it receives to the requests by their id, so that requests
+// can share the connection when the server multiplexes.
+type fCgiConn struct {
+	rwc          net.Conn
+	rd           *bufio.Reader
+	pool         *fCgiConnPool
+	server       string
+	keepConn     bool
+	mpx          bool
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	wmu          sync.Mutex
+	buf          bytes.Buffer
+	mu           sync.Mutex
+	reqs         map[uint16]*fCgiRequest
+	nextId       uint16
+	waiting      int
+	values       chan *fCgiCaps
+	broken       bool
+	err          error
+
+	// guarded by pool.mu
+	active   int
+	requests int
+	lastUsed time.Time
+}
+
+func dialFcgi(server string, keepConn bool, timeout time.Duration) (conn *fCgiConn, err error) {
+	network := "tcp"
+	if strings.HasPrefix(server, "unix:") {
+		network = "unix"
+		server = server[5:]
+	}
+	rwc, err := net.DialTimeout(network, server, timeout)
+	if err != nil {
+		return
+	}
+	conn = &fCgiConn{
+		rwc:      rwc,
+		rd:       bufio.NewReader(rwc),
+		server:   server,
+		keepConn: keepConn,
+		reqs:     make(map[uint16]*fCgiRequest),
+		values:   make(chan *fCgiCaps, 1),
+		lastUsed: time.Now(),
+	}
+	return
+}
+
+// decodeFcgiCaps reads the capacity values of an FCGI_GET_VALUES_RESULT.
+func decodeFcgiCaps(content []byte) *fCgiCaps {
+	values := decodeFcgiParams(content)
+	caps := &fCgiCaps{}
+	caps.MaxConns, _ = strconv.Atoi(values[fCgiMaxConns])
+	caps.MaxReqs, _ = strconv.Atoi(values[fCgiMaxReqs])
+	caps.Mpxs = values[fCgiMpxsConns] == "1"
+	return caps
+}
+
+func (conn *fCgiConn) Broken() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.broken
+}
+
+func (conn *fCgiConn) Close() {
+	conn.fail(errFcgiConnClosed)
+}
+
+// fail closes the connection and ends the requests still on it with err.
+func (conn *fCgiConn) fail(err error) {
+	conn.mu.Lock()
+	if conn.broken {
+		conn.mu.Unlock()
+		return
+	}
+	conn.broken = true
+	conn.err = err
+	var released []*fCgiRequest
+	for id, req := range conn.reqs {
+		delete(conn.reqs, id)
+		if req.finish(err) {
+			released = append(released, req)
+		}
+	}
+	conn.mu.Unlock()
+	conn.rwc.Close()
+	for range released {
+		conn.Release()
+	}
+}
+
+func (conn *fCgiConn) Report(err error) {
+	if conn.pool != nil {
+		conn.pool.health.Report(err)
+	}
+}
+
+func (conn *fCgiConn) Release() {
+	if conn.pool != nil {
+		conn.pool.Put(conn)
+	} else {
+		conn.Close()
+	}
+}
+
+func (conn *fCgiConn) writeRecord(recType uint8, id uint16, content []byte) (err error) {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+	conn.buf.Reset()
+	h := fCgiHeader{
+		Version:       fCgiVersion1,
+		Type:          recType,
+		Id:            id,
+		ContentLength: uint16(len(content)),
+		PaddingLength: uint8(-len(content) & 7),
+	}
+	if err = binary.Write(&conn.buf, binary.BigEndian, h); err != nil {
+		return
+	}
+	conn.buf.Write(content)
+	conn.buf.Write(make([]byte, h.PaddingLength))
+	if conn.writeTimeout > 0 {
+		conn.rwc.SetWriteDeadline(time.Now().Add(conn.writeTimeout))
+	}
+	if _, err = conn.rwc.Write(conn.buf.Bytes()); err != nil {
+		conn.fail(err)
+	}
+	return
+}
+
+func (conn *fCgiConn) writeStream(recType uint8, id uint16, content []byte) (err error) {
+	for len(content) > 0 {
+		n := len(content)
+		if n > fCgiMaxWrite {
+			n = fCgiMaxWrite
+		}
+		if err = conn.writeRecord(recType, id, content[:n]); err != nil {
+			return
+		}
+		content = content[n:]
+	}
+	return conn.writeRecord(recType, id, nil)
+}
+
+func (conn *fCgiConn) writeBeginRequest(id uint16) error {
+	var flags uint8
+	if conn.keepConn {
+		flags = fCgiKeepConn
+	}
+	b := [8]byte{byte(fCgiResponder >> 8), byte(fCgiResponder), flags}
+	return conn.writeRecord(fCgiBeginRequest, id, b[:])
+}
+
+func encodeFcgiSize(b []byte, size uint32) int {
+	if size > 127 {
+		size |= 1 << 31
+		binary.BigEndian.PutUint32(b, size)
+		return 4
+	}
+	b[0] = byte(size)
+	return 1
+}
+
+func encodeFcgiParams(params map[string]string) []byte {
+	var buf bytes.Buffer
+	b := make([]byte, 8)
+	for k, v := range params {
+		n := encodeFcgiSize(b, uint32(len(k)))
+		n += encodeFcgiSize(b[n:], uint32(len(v)))
+		buf.Write(b[:n])
+		buf.WriteString(k)
+		buf.WriteString(v)
+	}
+	return buf.Bytes()
+}
+
+func decodeFcgiSize(b []byte) (size uint32, n int) {
+	if len(b) > 0 && b[0]>>7 == 0 {
+		return uint32(b[0]), 1
+	}
+	if len(b) < 4 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint32(b) &^ (1 << 31), 4
+}
+
+func decodeFcgiParams(b []byte) map[string]string {
+	params := make(map[string]string)
+	for len(b) > 0 {
+		keyLen, n := decodeFcgiSize(b)
+		if n == 0 {
+			break
+		}
+		b = b[n:]
+		valLen, n := decodeFcgiSize(b)
+		if n == 0 || uint64(len(b)-n) < uint64(keyLen)+uint64(valLen) {
+			break
+		}
+		b = b[n:]
+		params[string(b[:keyLen])] = string(b[keyLen : keyLen+valLen])
+		b = b[keyLen+valLen:]
+	}
+	return params
+}
+
+func (conn *fCgiConn) readRecord() (h fCgiHeader, content []byte, err error) {
+	if err = binary.Read(conn.rd, binary.BigEndian, &h); err != nil {
+		return
+	}
+	if h.Version != fCgiVersion1 {
+		err = errors.New("fcgi: invalid header version")
+		return
+	}
+	content = make([]byte, int(h.ContentLength)+int(h.PaddingLength))
+	if _, err = io.ReadFull(conn.rd, content); err != nil {
+		return
+	}
+	content = content[:h.ContentLength]
+	return
+}
+
+// armRead puts read_timeout on the next read while responses are awaited;
+// idle connections wait for the server without a deadline.
+func (conn *fCgiConn) armRead() {
+	if conn.readTimeout <= 0 {
+		return
+	}
+	if conn.waiting > 0 {
+		conn.rwc.SetReadDeadline(time.Now().Add(conn.readTimeout))
+	} else {
+		conn.rwc.SetReadDeadline(time.Time{})
+	}
+}
+
+func (conn *fCgiConn) readLoop() {
+	for {
+		conn.mu.Lock()
+		conn.armRead()
+		conn.mu.Unlock()
+		h, content, err := conn.readRecord()
+		if err != nil {
+			conn.fail(err)
+			return
+		}
+		if h.Id == 0 {
+			if h.Type == fCgiGetValuesResult {
+				select {
+				case conn.values <- decodeFcgiCaps(content):
+				default:
+				}
+			}
+			continue
+		}
+		conn.mu.Lock()
+		req := conn.reqs[h.Id]
+		conn.mu.Unlock()
+		if req == nil {
+			continue
+		}
+		switch h.Type {
+		case fCgiStdout:
+			if len(content) > 0 {
+				req.deliver(content)
+			}
+		case fCgiStderr:
+			if len(content) > 0 {
+				log.Printf("fcgi-stderr: server=%s id=%d %s", conn.server, h.Id, strings.TrimSpace(string(content)))
+			}
+		case fCgiEndRequest:
+			var status uint8
+			if len(content) > 4 {
+				status = content[4]
+			}
+			conn.end(req, status)
+		}
+	}
+}
+
+func (conn *fCgiConn) end(req *fCgiRequest, status uint8) {
+	var err error
+	switch status {
+	case fCgiRequestComplete:
+	case fCgiCantMpxConn:
+		err = errFcgiCantMpxConn
+	case fCgiOverloaded:
+		err = errFcgiOverloaded
+	case fCgiUnknownRole:
+		err = errFcgiUnknownRole
+	default:
+		err = fmt.Errorf("fcgi: unknown protocol status %d", status)
+	}
+	conn.mu.Lock()
+	delete(conn.reqs, req.id)
+	if req.sent {
+		conn.waiting--
+	}
+	release := req.finish(err)
+	conn.mu.Unlock()
+	if release {
+		conn.Release()
+	}
+}
+
+func (conn *fCgiConn) newRequest(ctx context.Context) (req *fCgiRequest, err error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.broken {
+		return nil, conn.err
+	}
+	for {
+		conn.nextId++
+		if conn.nextId == 0 {
+			conn.nextId = 1
+		}
+		if _, ok := conn.reqs[conn.nextId]; !ok {
+			break
+		}
+	}
+	req = &fCgiRequest{
+		id:      conn.nextId,
+		conn:    conn,
+		ctx:     ctx,
+		ready:   make(chan bool, 1),
+		drained: make(chan bool, 1),
+		done:    make(chan bool),
+		aborted: make(chan bool),
+	}
+	conn.reqs[req.id] = req
+	return
+}
+
+// fCgiRequest reads the stdout of one request. The connection's reader
+// buffers stdout per request, so a slow client does not hold up the other
+// requests on the connection, nor a server that answers before it has
+// read all of stdin.
+type fCgiRequest struct {
+	id        uint16
+	conn      *fCgiConn
+	ctx       context.Context
+	bufMu     sync.Mutex
+	stdout    [][]byte
+	buffered  int
+	ready     chan bool
+	drained   chan bool
+	done      chan bool
+	aborted   chan bool
+	abortOnce sync.Once
+	err       error
+
+	// guarded by conn.mu
+	sent   bool
+	ended  bool
+	closed bool
+}
+
+// finish marks req as ended and reports whether its connection is to be
+// released for it, which is when it was closed before it ended.
+func (req *fCgiRequest) finish(err error) bool {
+	if req.ended {
+		return false
+	}
+	req.ended = true
+	req.err = err
+	close(req.done)
+	return req.closed
+}
+
+func notify(ch chan bool) {
+	select {
+	case ch <- true:
+	default:
+	}
+}
+
+// deliver queues content for the reader. Past fCgiMaxBuffered it waits
+// for the reader, but only once stdin is sent and while the request has
+// the connection to itself, so that waiting stalls nothing else.
+func (req *fCgiRequest) deliver(content []byte) {
+	select {
+	case <-req.aborted:
+		return
+	default:
+	}
+	req.bufMu.Lock()
+	req.stdout = append(req.stdout, content)
+	req.buffered += len(content)
+	req.bufMu.Unlock()
+	notify(req.ready)
+	for {
+		req.bufMu.Lock()
+		over := req.buffered > fCgiMaxBuffered
+		req.bufMu.Unlock()
+		req.conn.mu.Lock()
+		wait := req.sent && len(req.conn.reqs) == 1
+		req.conn.mu.Unlock()
+		if !over || !wait {
+			return
+		}
+		select {
+		case <-req.drained:
+		case <-req.aborted:
+			return
+		}
+	}
+}
+
+// take copies buffered stdout into p.
+func (req *fCgiRequest) take(p []byte) (n int) {
+	req.bufMu.Lock()
+	for len(req.stdout) > 0 && n < len(p) {
+		c := copy(p[n:], req.stdout[0])
+		n += c
+		if c == len(req.stdout[0]) {
+			req.stdout = req.stdout[1:]
+		} else {
+			req.stdout[0] = req.stdout[0][c:]
+		}
+	}
+	req.buffered -= n
+	req.bufMu.Unlock()
+	if n > 0 {
+		notify(req.drained)
+	}
+	return
+}
+
+func (req *fCgiRequest) Read(p []byte) (n int, err error) {
+	for {
+		if n = req.take(p); n > 0 {
+			return
+		}
+		select {
+		case <-req.ready:
+		case <-req.done:
+			if n = req.take(p); n > 0 {
+				return
+			}
+			if req.err != nil {
+				return 0, req.err
+			}
+			return 0, io.EOF
+		case <-req.aborted:
+			if err = req.ctx.Err(); err == nil {
+				err = errFcgiAborted
+			}
+			return 0, err
+		}
+	}
+}
+
+// watch aborts the request when the client goes away before it ended.
+func (req *fCgiRequest) watch() {
+	select {
+	case <-req.ctx.Done():
+		req.abort()
+	case <-req.done:
+	}
+}
+
+// abort sends FCGI_ABORT_REQUEST, leaving the request on the connection
+// until the server ends it so that the connection can be reused.
+func (req *fCgiRequest) abort() {
+	req.abortOnce.Do(func() {
+		close(req.aborted)
+		select {
+		case <-req.done:
+			return
+		default:
+		}
+		if err := req.conn.writeRecord(fCgiAbortRequest, req.id, nil); err != nil {
+			return
+		}
+		time.AfterFunc(fCgiAbortTimeout, func() {
+			select {
+			case <-req.done:
+			default:
+				log.Printf("fcgi-err: server=%s id=%d abort timed out", req.conn.server, req.id)
+				req.conn.fail(errFcgiAborted)
+			}
+		})
+	})
+}
+
+// Close releases the connection, or aborts the request when it has not
+// ended yet and releases the connection once it has.
+func (req *fCgiRequest) Close() error {
+	conn := req.conn
+	conn.mu.Lock()
+	if req.closed {
+		conn.mu.Unlock()
+		return nil
+	}
+	req.closed = true
+	ended := req.ended
+	conn.mu.Unlock()
+	if ended {
+		conn.Release()
+	} else {
+		req.abort()
+	}
+	return nil
+}
+
+type fCgiResponseBody struct {
+	io.Reader
+	req *fCgiRequest
+}
+
+func (body *fCgiResponseBody) Close() error {
+	return body.req.Close()
+}
+
+// Request sends a request to the server and reads the response headers.
+// The connection is released when the response body is closed, or by
+// Request itself when it fails.
+func (conn *fCgiConn) Request(ctx context.Context, params map[string]string, body io.Reader) (resp *http.Response, err error) {
+	req, err := conn.newRequest(ctx)
+	if err != nil {
+		conn.Release()
+		return
+	}
+	go req.watch()
+	defer func() {
+		if err != nil {
+			req.Close()
+		}
+	}()
+	if err = conn.writeBeginRequest(req.id); err != nil {
+		return
+	}
+	if err = conn.writeStream(fCgiParams, req.id, encodeFcgiParams(params)); err != nil {
+		return
+	}
+	if body != nil {
+		b := make([]byte, fCgiMaxWrite)
+		for {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			n, rerr := body.Read(b)
+			if n > 0 {
+				if err = conn.writeRecord(fCgiStdin, req.id, b[:n]); err != nil {
+					return
+				}
+			}
+			if rerr == io.EOF {
+				break
+			} else if rerr != nil {
+				err = rerr
+				return
+			}
+		}
+	}
+	if err = conn.writeRecord(fCgiStdin, req.id, nil); err != nil {
+		return
+	}
+	conn.mu.Lock()
+	if !req.ended {
+		req.sent = true
+		conn.waiting++
+		conn.armRead()
+	}
+	conn.mu.Unlock()
+
+	rb := bufio.NewReader(req)
+	tp := textproto.NewReader(rb)
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return
+	}
+	err = nil
+	resp = &http.Response{
+		Header:     http.Header(mimeHeader),
+		StatusCode: http.StatusOK,
+	}
+	if status := resp.Header.Get("Status"); status != "" {
+		resp.Status = status
+		if v, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0]); err == nil {
+			resp.StatusCode = v
+		}
+	}
+	resp.TransferEncoding = resp.Header["Transfer-Encoding"]
+	resp.ContentLength = -1
+	if v, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = v
+	}
+	var reader io.Reader = rb
+	if len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked" {
+		reader = httputil.NewChunkedReader(rb)
+	}
+	resp.Body = &fCgiResponseBody{Reader: reader, req: req}
+	return
+}
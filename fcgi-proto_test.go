@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFcgiParamsRoundTrip(t *testing.T) {
+	params := map[string]string{
+		"SCRIPT_FILENAME":        "/var/www/index.php",
+		"EMPTY":                  "",
+		"LONG_VALUE":             strings.Repeat("v", 300),
+		strings.Repeat("K", 200): "long key",
+	}
+	got := decodeFcgiParams(encodeFcgiParams(params))
+	if len(got) != len(params) {
+		t.Fatalf("decoded %d params, want %d", len(got), len(params))
+	}
+	for k, v := range params {
+		if got[k] != v {
+			t.Errorf("param %.20q = %.20q, want %.20q", k, got[k], v)
+		}
+	}
+}
+
+func TestFcgiParamsTruncated(t *testing.T) {
+	b := encodeFcgiParams(map[string]string{"NAME": strings.Repeat("v", 200)})
+	for n := 0; n < len(b); n++ {
+		if got := decodeFcgiParams(b[:n]); len(got) != 0 {
+			t.Fatalf("decoding %d of %d bytes gave %v", n, len(b), got)
+		}
+	}
+}
+
+func TestFcgiSize(t *testing.T) {
+	for _, size := range []uint32{0, 127, 128, 1 << 20, 1<<31 - 1} {
+		b := make([]byte, 4)
+		n := encodeFcgiSize(b, size)
+		got, m := decodeFcgiSize(b[:n])
+		if got != size || m != n {
+			t.Errorf("size %d: decoded %d from %d of %d bytes", size, got, m, n)
+		}
+	}
+}
+
+func TestDecodeFcgiCaps(t *testing.T) {
+	caps := decodeFcgiCaps(encodeFcgiParams(map[string]string{
+		fCgiMaxConns:  "2",
+		fCgiMaxReqs:   "3",
+		fCgiMpxsConns: "1",
+	}))
+	if caps.MaxConns != 2 || caps.MaxReqs != 3 || !caps.Mpxs {
+		t.Errorf("caps = %s", caps)
+	}
+	caps = decodeFcgiCaps(nil)
+	if caps.MaxConns != 0 || caps.MaxReqs != 0 || caps.Mpxs {
+		t.Errorf("empty caps = %s", caps)
+	}
+}
+
+func TestFcgiRecordRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	wconn := &fCgiConn{rwc: client}
+	rconn := &fCgiConn{rwc: server, rd: bufio.NewReader(server)}
+
+	content := bytes.Repeat([]byte("0123456789"), 7000)
+	errch := make(chan error, 1)
+	go func() {
+		errch <- wconn.writeStream(fCgiStdin, 7, content)
+	}()
+
+	var got []byte
+	records := 0
+	for {
+		h, b, err := rconn.readRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		records++
+		if h.Version != fCgiVersion1 || h.Type != fCgiStdin || h.Id != 7 {
+			t.Fatalf("header = %+v", h)
+		}
+		if int(h.ContentLength) != len(b) || (int(h.ContentLength)+int(h.PaddingLength))%8 != 0 {
+			t.Fatalf("content length %d, padding %d, read %d", h.ContentLength, h.PaddingLength, len(b))
+		}
+		if len(b) == 0 {
+			break
+		}
+		got = append(got, b...)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("read %d bytes, want %d", len(got), len(content))
+	}
+	if records != 3 {
+		t.Errorf("stream took %d records, want 3", records)
+	}
+}
+
+func TestFcgiRecordBadVersion(t *testing.T) {
+	b := []byte{2, fCgiStdout, 0, 1, 0, 0, 0, 0}
+	conn := &fCgiConn{rd: bufio.NewReader(bytes.NewReader(b))}
+	if _, _, err := conn.readRecord(); err == nil {
+		t.Error("expected an error for version 2")
+	}
+}
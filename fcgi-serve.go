@@ -1,18 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"regexp"
 	"runtime"
-	"strconv"
 	"strings"
-	"time"
-
-	"github.com/tomasen/fcgi_client"
 )
 
 var cookieNameSanitizer = strings.NewReplacer("\n", "-", "\r", "-")
@@ -57,17 +54,108 @@ func sanitizeOrWarn(fieldName string, valid func(byte) bool, v string) string {
 	return string(buf)
 }
 
+var errFcgiResponseTooLarge = errors.New("Fast cgi response too large")
+
 type fCgiHandler struct {
-	clients *fCgiClients
-	fCfg    *cfgFCgiOpts
-	pCfg    *config
-	laddr   string
+	clients   *fCgiClients
+	fCfg      *cfgFCgiOpts
+	pCfg      *config
+	site      *cfgSite
+	laddr     string
+	splitPath *regexp.Regexp
+}
+
+func newFcgiHandler(gen *generation, clients *fCgiClients, fCfg *cfgFCgiOpts, site *cfgSite, laddr string) (hndlr *fCgiHandler) {
+	hndlr = &fCgiHandler{clients: clients, fCfg: fCfg, pCfg: gen.GetCfg(), site: site, laddr: laddr}
+	if fCfg.SplitPath != "" {
+		hndlr.splitPath = regexp.MustCompile(fCfg.SplitPath)
+	}
+	return
+}
+
+func (hndlr *fCgiHandler) copyResponse(rw http.ResponseWriter, resp *http.Response) (headerSent bool, err error) {
+	maxSize := hndlr.site.MaxResponseSize
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return false, errFcgiResponseTooLarge
+	}
+	for k, v := range resp.Header {
+		if k == "Status" {
+			continue
+		}
+		for i, v2 := range v {
+			if i == 0 {
+				rw.Header().Set(k, v2)
+			} else {
+				rw.Header().Add(k, v2)
+			}
+		}
+	}
+	if resp.StatusCode != 0 {
+		rw.WriteHeader(resp.StatusCode)
+	}
+	headerSent = true
+	flusher, canFlush := rw.(http.Flusher)
+	if canFlush {
+		flusher.Flush()
+	}
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			written += int64(n)
+			if maxSize > 0 && written > maxSize {
+				return headerSent, errFcgiResponseTooLarge
+			}
+			if _, err = rw.Write(buf[:n]); err != nil {
+				return
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			return
+		} else if rerr != nil {
+			return headerSent, rerr
+		}
+	}
 }
 
 func (hndlr *fCgiHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !hndlr.clients.Available() {
+		hndlr.writeError(rw, errFcgiUnavailable)
+		return
+	}
+	if req.ContentLength < 0 && req.Body != nil && req.Body != http.NoBody {
+		bufferSize := hndlr.site.BodyBufferSize
+		if bufferSize <= 0 {
+			bufferSize = defaultBodyBufferSize
+		}
+		maxSize := hndlr.site.MaxBodySize
+		if maxSize <= 0 {
+			maxSize = defaultSpoolMaxSize
+		}
+		body, size, err := spoolBody(req.Body, bufferSize, maxSize)
+		if err == errRequestBodyTooLarge {
+			writeBodyTooLarge(rw)
+			return
+		} else if err != nil {
+			log.Println("fcgi-err:", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("400: Bad Request"))
+			return
+		}
+		defer body.Close()
+		req = req.WithContext(req.Context())
+		req.Body = body
+		req.ContentLength = size
+	}
 	errch := make(chan error, 1)
+	headerSent := false
 	hndlr.clients.Jobs() <- &fCgiClientJob{
-		process: func(fcgi *fcgiclient.FCGIClient, err error) {
+		req: req,
+		process: func(fcgi *fCgiConn, err error) {
 			defer func() {
 				if r := recover(); r != nil {
 					if r != nil {
@@ -86,122 +174,58 @@ func (hndlr *fCgiHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			}()
 
 			if fcgi == nil {
-				errch <- errors.New("No fast cgi available")
+				errch <- errFcgiUnavailable
 				return
 			}
+			setUpstream(req, hndlr.clients.name, fcgi.server)
 
-			remoteAddr := strings.SplitN(req.RemoteAddr, ":", 2)
-			serverAddr := strings.SplitN(hndlr.laddr, ":", 2)
-			fileName := fmt.Sprintf(hndlr.fCfg.Script, req.URL.Path)
-			if hndlr.fCfg.Index != "" {
-				n := len(fileName)
-				if fileName[n-1] == '/' {
-					fileName = fileName + hndlr.fCfg.Index
-				}
-			}
-
-			params := make(map[string]string)
-			params["SCRIPT_FILENAME"] = fileName
-			params["SERVER_SOFTWARE"] = "goweb/1.0"
-			params["REQUEST_URI"] = req.RequestURI
-			params["REQUEST_METHOD"] = req.Method
-			params["SERVER_PROTOCOL"] = req.Proto
-			params["REMOTE_ADDR"] = remoteAddr[0]
-			params["REMOTE_PORT"] = remoteAddr[1]
-			params["SERVER_ADDR"] = serverAddr[0]
-			params["SERVER_PORT"] = serverAddr[1]
-			for k, v := range req.Header {
-				if len(v) > 0 {
-					pk := fmt.Sprintf("HTTP_%s", strings.ToUpper(strings.Replace(k, "-", "_", 0)))
-					if _, ok := params[pk]; !ok {
-						params[pk] = strings.Join(v, "; ")
-					}
-				}
-			}
-			if _, ok := params["HTTP_HOST"]; !ok {
-				params["HTTP_HOST"] = serverAddr[0]
-			}
-			if _, ok := params["HTTP_CONNECTION"]; !ok {
-				params["HTTP_CONNECTION"] = "keep-alive"
-			}
-			if _, ok := params["HTTP_COOKIE"]; !ok {
-				cookies := ""
-				for i, cookie := range req.Cookies() {
-					cookieStr := fmt.Sprintf("%s=%s", sanitizeCookieName(cookie.Name), sanitizeCookieValue(cookie.Value))
-					if i == 0 {
-						cookies = cookieStr
-					} else {
-						cookies = fmt.Sprintf("%s; %s", cookies, cookieStr)
-					}
-				}
-				if cookies != "" {
-					params["HTTP_COOKIE"] = cookies
-				}
-			}
-			params["REQUEST_TIME"] = strconv.Itoa(int(time.Now().Unix()))
-			for k, v := range hndlr.fCfg.Params {
-				params[k] = v
-			}
+			params := hndlr.params(req)
 			var body io.Reader
-			if req.Method == "HEAD" || req.Method == "GET" || req.Method == "OPTIONS" || req.Method == "DELTET" {
-				params["QUERY_STRING"] = req.URL.RawQuery
+			if req.ContentLength != 0 {
+				body = clientBody{req.Body}
 			}
-			if req.Method == "OPTIONS" || req.Method == "PUT" || req.Method == "DELTET" || req.Method == "PATCH" || req.Method == "POST" {
-				if v := req.Header.Get("Content-Type"); v != "" {
-					params["CONTENT_TYPE"] = v
-				} else {
-					params["CONTENT_TYPE"] = "application/x-www-form-urlencoded"
-				}
-				if v := req.Header.Get("Content-Length"); v != "" {
-					if v2, err := strconv.Atoi(v); err == nil {
-						params["CONTENT_LENGTH"] = strconv.Itoa(v2)
-					}
-				}
-				body = req.Body
+			resp, err := fcgi.Request(req.Context(), params, body)
+			if req.Context().Err() == nil && !isClientBodyError(err) {
+				fcgi.Report(err)
 			}
-			if resp, err := fcgi.Request(params, body); err == nil {
-				if content, err := ioutil.ReadAll(resp.Body); err == nil {
-					for k, v := range resp.Header {
-						for i, v2 := range v {
-							if i == 0 {
-								if k == "Status" && resp.StatusCode == 0 {
-									status := strings.SplitN(v2, " ", 2)
-									if v3, err := strconv.Atoi(status[0]); err == nil {
-										resp.StatusCode = v3
-									}
-								}
-								rw.Header().Set(k, v2)
-							} else {
-								rw.Header().Add(k, v2)
-							}
-						}
-					}
-					if resp.StatusCode != 0 {
-						rw.WriteHeader(resp.StatusCode)
-					}
-					if _, err := rw.Write(content); err == nil {
-						errch <- nil
-					} else {
-						errch <- err
-					}
-				} else {
-					errch <- err
-				}
-			} else {
-				errch <- err
+			if err == nil {
+				defer resp.Body.Close()
+				headerSent, err = hndlr.copyResponse(rw, resp)
 			}
+			errch <- err
 		},
 	}
 	if err := <-errch; err != nil {
-		if err != io.EOF && err.Error() != "No fast cgi available" {
+		if headerSent {
+			// Abort the response so that neither the client nor a cache
+			// takes the truncated body for a complete one.
 			log.Println("fcgi-err:", err)
+			panic(http.ErrAbortHandler)
 		}
-		rw.Header().Set("", "text/plain")
-		rw.WriteHeader(http.StatusInternalServerError)
-		body := "500: Internal Server Error"
-		if !hndlr.pCfg.Live {
-			body += "\n" + err.Error()
-		}
-		rw.Write([]byte(body))
+		hndlr.writeError(rw, err)
+	}
+}
+
+func (hndlr *fCgiHandler) writeError(rw http.ResponseWriter, err error) {
+	if err != io.EOF && err != errFcgiUnavailable && err != context.Canceled {
+		log.Println("fcgi-err:", err)
+	}
+	if errors.Is(err, errRequestBodyTooLarge) {
+		writeBodyTooLarge(rw)
+		return
+	}
+	rw.Header().Set("", "text/plain")
+	status, body := http.StatusInternalServerError, "500: Internal Server Error"
+	if isClientBodyError(err) {
+		status, body = http.StatusBadRequest, "400: Bad Request"
+	} else if err == errFcgiResponseTooLarge {
+		status, body = http.StatusBadGateway, "502: Bad Gateway"
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		status, body = http.StatusGatewayTimeout, "504: Gateway Timeout"
+	}
+	rw.WriteHeader(status)
+	if !hndlr.pCfg.Live {
+		body += "\n" + err.Error()
 	}
+	rw.Write([]byte(body))
 }
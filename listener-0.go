@@ -1,23 +1,115 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 type listener interface {
-	AddSite(site *cfgSite)
+	SetGeneration(gen *generation)
+	Compatible(site *cfgSite) bool
+	Bind() error
 	Open()
-	Close()
+	Close(grace time.Duration)
 	IsOpen() bool
+	ReleasedCh() chan bool
 	ClosedCh() chan bool
 }
 
+// listenerState tracks whether a listener is serving. Close always closes
+// Released once the socket is given up and Closed once the connections
+// are drained, also when Open has not run yet or failed, so callers
+// waiting on them never hang.
+type listenerState struct {
+	mu          sync.Mutex
+	running     bool
+	closed      bool
+	closing     chan bool
+	Released    chan bool
+	Closed      chan bool
+	releaseOnce sync.Once
+	closeOnce   sync.Once
+}
+
+// start marks the listener running unless it is running or closed already.
+func (state *listenerState) start() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.running || state.closed {
+		return false
+	}
+	state.running = true
+	return true
+}
+
+// stop marks the listener closed and tells whether it was running.
+func (state *listenerState) stop() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	wasRunning := state.running
+	state.running = false
+	state.closed = true
+	return wasRunning
+}
+
+func (state *listenerState) release() {
+	state.releaseOnce.Do(func() {
+		close(state.Released)
+	})
+}
+
+func (state *listenerState) done() {
+	state.release()
+	state.closeOnce.Do(func() {
+		close(state.Closed)
+	})
+}
+
+func (state *listenerState) IsOpen() bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.running
+}
+
+func (state *listenerState) ReleasedCh() chan bool {
+	return state.Released
+}
+
+func (state *listenerState) ClosedCh() chan bool {
+	return state.Closed
+}
+
+func newListenerState() listenerState {
+	return listenerState{closing: make(chan bool, 1), Released: make(chan bool), Closed: make(chan bool)}
+}
+
+// tcpKeepAliveListener tells its listenerState when the socket is closed,
+// which a shutdown does before it drains the connections.
 type tcpKeepAliveListener struct {
 	*net.TCPListener
+	state *listenerState
+}
+
+func (ln tcpKeepAliveListener) Close() error {
+	err := ln.TCPListener.Close()
+	ln.state.release()
+	return err
+}
+
+func listenTCP(laddr string, state *listenerState) (net.Listener, error) {
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return tcpKeepAliveListener{ln.(*net.TCPListener), state}, nil
 }
 
 func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
@@ -30,42 +122,111 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
-func addSite(srv *server, srvMux *serveMux, laddr string, site *cfgSite, mapDefault bool) {
+func shutdownServer(httpSrv *http.Server, laddr string, grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := httpSrv.Shutdown(ctx); err != nil {
+		log.Printf("Listener shutdown timed out: laddr=%s err=%v", laddr, err)
+		httpSrv.Close()
+	}
+}
+
+func newHttp2Server(opts *cfgHttp2Opts) *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams:         opts.MaxConcurrentStreams,
+		MaxReadFrameSize:             opts.MaxReadFrameSize,
+		MaxUploadBufferPerConnection: opts.ConnWindowSize,
+		MaxUploadBufferPerStream:     opts.StreamWindowSize,
+		IdleTimeout:                  opts.IdleTimeout,
+	}
+}
+
+type muxHandler struct {
+	gen   *generation
+	mux   *serveMux
+	laddr string
+}
+
+// handlerSwitch lets a running listener move to a new configuration
+// generation while requests already in flight finish on the old one.
+type handlerSwitch struct {
+	current atomic.Value
+}
+
+func (sw *handlerSwitch) SetMux(gen *generation, laddr string) {
+	sw.current.Store(&muxHandler{gen: gen, mux: gen.muxes[laddr], laddr: laddr})
+}
+
+func (sw *handlerSwitch) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	for {
+		h := sw.current.Load().(*muxHandler)
+		if h.gen.Acquire() {
+			defer h.gen.Release()
+			if serveAcmeChallenge(h.gen, rw, req) {
+				return
+			}
+			site := h.gen.siteFor(h.laddr, req.Host)
+			var hndlr http.Handler = h.mux
+			if site != nil && site.Compress != nil {
+				hndlr = &compressHandler{opts: site.Compress, next: hndlr}
+			}
+			if site != nil && site.MaxBodySize > 0 {
+				hndlr = &bodyLimitHandler{max: site.MaxBodySize, next: hndlr}
+			}
+			serveObserved(h.gen.accessLogs[site], site, h.laddr, hndlr, rw, req)
+			return
+		}
+		if sw.current.Load().(*muxHandler) == h {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			rw.Write([]byte("503: Service Unavailable"))
+			return
+		}
+	}
+}
+
+func withCache(gen *generation, name string, h http.Handler) http.Handler {
+	if zone, ok := gen.GetCache(name); ok {
+		return &cacheHandler{gen: gen, zone: zone, next: h}
+	}
+	return h
+}
+
+func addSite(gen *generation, srvMux *serveMux, laddr string, site *cfgSite, mapDefault bool) {
 	if mapDefault {
 		log.Printf("Adding Site: host=%s laddr=%s, root=%s", "default", laddr, site.Root)
 		if site.Root != "" {
-			srvMux.Handle("/", http.FileServer(http.Dir(site.Root)))
+			srvMux.Handle("/", newStaticHandler(site, srvMux))
 		}
 		site.FCgi.Each(func(idx int, fCgiOpts *cfgFCgiOpts) bool {
-			if fCgiClients, ok := srv.GetFcgi(fCgiOpts.Server); ok {
+			if fCgiClients, ok := gen.GetFcgi(fCgiOpts.Server); ok {
 				log.Printf("Adding Site FCgi: host=%s laddr=%s, fcgi_server=%s, path_pattern=%s", "default", laddr, fCgiOpts.Server, fCgiOpts.Pattern)
-				srvMux.HandleMatch("", fCgiOpts.Pattern, &fCgiHandler{clients: fCgiClients, fCfg: fCgiOpts, pCfg: srv.GetCfg(), laddr: laddr})
+				srvMux.HandleMatch("", fCgiOpts.Pattern, withCache(gen, fCgiOpts.Cache, newFcgiHandler(gen, fCgiClients, fCgiOpts, site, laddr)))
 			}
 			return true
 		})
 		site.Proxy.Each(func(idx int, proxyOpts *cfgProxyOpts) bool {
-			if proxyClients, ok := srv.GetProxy(proxyOpts.Server); ok {
+			if proxyClients, ok := gen.GetProxy(proxyOpts.Server); ok {
 				log.Printf("Adding Site FCgi: host=%s laddr=%s, fcgi_server=%s, path_pattern=%s", "default", laddr, proxyOpts.Server, proxyOpts.Pattern)
-				srvMux.HandleMatch("", proxyOpts.Pattern, proxyClients)
+				srvMux.HandleMatch("", proxyOpts.Pattern, withCache(gen, proxyOpts.Cache, proxyClients))
 			}
 			return true
 		})
 	}
 	log.Printf("Adding Site: host=%s laddr=%s, root=%s", site.Host, laddr, site.Root)
 	if site.Root != "" {
-		srvMux.Handle(fmt.Sprintf("%s/", site.Host), http.FileServer(http.Dir(site.Root)))
+		srvMux.Handle(fmt.Sprintf("%s/", site.Host), newStaticHandler(site, srvMux))
 	}
 	site.FCgi.Each(func(idx int, fCgiOpts *cfgFCgiOpts) bool {
-		if fCgiClients, ok := srv.GetFcgi(fCgiOpts.Server); ok {
+		if fCgiClients, ok := gen.GetFcgi(fCgiOpts.Server); ok {
 			log.Printf("Adding Site FCgi: host=%s laddr=%s, fcgi_server=%s, path_pattern=%s", site.Host, laddr, fCgiOpts.Server, fCgiOpts.Pattern)
-			srvMux.HandleMatch(site.Host, fCgiOpts.Pattern, &fCgiHandler{clients: fCgiClients, fCfg: fCgiOpts, pCfg: srv.GetCfg(), laddr: laddr})
+			srvMux.HandleMatch(site.Host, fCgiOpts.Pattern, withCache(gen, fCgiOpts.Cache, newFcgiHandler(gen, fCgiClients, fCgiOpts, site, laddr)))
 		}
 		return true
 	})
 	site.Proxy.Each(func(idx int, proxyOpts *cfgProxyOpts) bool {
-		if proxyClients, ok := srv.GetProxy(proxyOpts.Server); ok {
+		if proxyClients, ok := gen.GetProxy(proxyOpts.Server); ok {
 			log.Printf("Adding Site FCgi: host=%s laddr=%s, fcgi_server=%s, path_pattern=%s", site.Host, laddr, proxyOpts.Server, proxyOpts.Pattern)
-			srvMux.HandleMatch(site.Host, proxyOpts.Pattern, proxyClients)
+			srvMux.HandleMatch(site.Host, proxyOpts.Pattern, withCache(gen, proxyOpts.Cache, proxyClients))
 		}
 		return true
 	})
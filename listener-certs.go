@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errNoCertificate = errors.New("no certificate for listener")
+
+func loadCertificate(opts *cfgSslOpts) (*tls.Certificate, error) {
+	certPEMBlock := make([]byte, 0)
+	keyPEMBlock := make([]byte, 0)
+	if f := opts.Chain; f != "" {
+		v, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		certPEMBlock = append(certPEMBlock, v...)
+	}
+	v, err := ioutil.ReadFile(opts.Cert)
+	if err != nil {
+		return nil, err
+	}
+	certPEMBlock = append(certPEMBlock, v...)
+	if keyPEMBlock, err = ioutil.ReadFile(opts.Key); err != nil {
+		return nil, err
+	}
+	passphrase := opts.KeyPass
+	priv, _ := pem.Decode(keyPEMBlock)
+	if priv == nil {
+		return nil, errors.New("Key file error: no pem data")
+	}
+	if x509.IsEncryptedPEMBlock(priv) {
+		if passphrase == "" {
+			return nil, errors.New("Key file error: no pass phrase given")
+		}
+		b, err := x509.DecryptPEMBlock(priv, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("Key file error: %v", err)
+		}
+		keyPEMBlock = pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: b,
+		})
+	} else if passphrase != "" {
+		return nil, errors.New("Key file error: invalid pass phrase given")
+	}
+	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// certNames lists the host names a certificate is valid for, falling back
+// to the common name for certificates without subject alternative names.
+func certNames(leaf *x509.Certificate) []string {
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	lower := make([]string, len(names))
+	for i, name := range names {
+		lower[i] = strings.ToLower(name)
+	}
+	return lower
+}
+
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// validateCertificate rejects a renewed certificate that is not valid now
+// or no longer covers a host the current one served.
+func validateCertificate(cert *tls.Certificate, hosts []string) error {
+	now := time.Now()
+	if now.Before(cert.Leaf.NotBefore) {
+		return fmt.Errorf("certificate not valid before %s", cert.Leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	for _, host := range hosts {
+		if err := cert.Leaf.VerifyHostname(host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// certEntry is the live certificate of one set of ssl options. Entries are
+// shared by all generations, so a renewed certificate is swapped in under
+// running listeners without a config reload.
+type certEntry struct {
+	opts   cfgSslOpts
+	cert   atomic.Value
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+	hosts  map[string]bool
+	warned time.Time
+}
+
+func (entry *certEntry) Load() *tls.Certificate {
+	return entry.cert.Load().(*tls.Certificate)
+}
+
+func (entry *certEntry) files() []string {
+	files := []string{entry.opts.Cert, entry.opts.Key}
+	if entry.opts.Chain != "" {
+		files = append(files, entry.opts.Chain)
+	}
+	return files
+}
+
+// Refresh reloads the certificate when its files changed. A certificate
+// that fails to load or validate is logged and the current one kept.
+func (entry *certEntry) Refresh() {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	stamps := statFiles(entry.files())
+	if sameStamps(stamps, entry.stamps) {
+		entry.checkExpiry()
+		return
+	}
+	entry.stamps = stamps
+	old := entry.Load()
+	var hosts []string
+	for host := range entry.hosts {
+		if old.Leaf.VerifyHostname(host) == nil {
+			hosts = append(hosts, host)
+		}
+	}
+	cert, err := loadCertificate(&entry.opts)
+	if err == nil {
+		err = validateCertificate(cert, hosts)
+	}
+	if err != nil {
+		log.Printf("Certificate error, keeping current certificate: cert=%s, %v", entry.opts.Cert, err)
+		return
+	}
+	entry.cert.Store(cert)
+	entry.warned = time.Time{}
+	log.Printf("Reloaded Certificate: cert=%s, names=%s, expires=%s", entry.opts.Cert, strings.Join(certNames(cert.Leaf), ","), cert.Leaf.NotAfter.Format(time.RFC3339))
+	entry.checkExpiry()
+}
+
+// checkExpiry logs a warning, at most once a day, when the certificate
+// expires within certExpiryWarning.
+func (entry *certEntry) checkExpiry() {
+	leaf := entry.Load().Leaf
+	left := time.Until(leaf.NotAfter)
+	if left > certExpiryWarning || time.Since(entry.warned) < 24*time.Hour {
+		return
+	}
+	entry.warned = time.Now()
+	if left <= 0 {
+		log.Printf("Certificate expired: cert=%s, names=%s, expired=%s", entry.opts.Cert, strings.Join(certNames(leaf), ","), leaf.NotAfter.Format(time.RFC3339))
+	} else {
+		log.Printf("Certificate expires soon: cert=%s, names=%s, expires=%s", entry.opts.Cert, strings.Join(certNames(leaf), ","), leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+var certEntries = struct {
+	sync.Mutex
+	m map[cfgSslOpts]*certEntry
+}{m: make(map[cfgSslOpts]*certEntry)}
+
+// getCertEntry returns the shared entry for opts, loading the certificate
+// the first time the options are used.
+func getCertEntry(opts *cfgSslOpts) (*certEntry, error) {
+	certEntries.Lock()
+	defer certEntries.Unlock()
+	if entry, ok := certEntries.m[*opts]; ok {
+		return entry, nil
+	}
+	entry := &certEntry{opts: *opts, hosts: make(map[string]bool)}
+	entry.stamps = statFiles(entry.files())
+	cert, err := loadCertificate(opts)
+	if err != nil {
+		return nil, err
+	}
+	entry.cert.Store(cert)
+	entry.checkExpiry()
+	certEntries.m[*opts] = entry
+	return entry, nil
+}
+
+// refreshCertificates reloads every certificate whose files changed.
+func refreshCertificates() {
+	certEntries.Lock()
+	entries := make([]*certEntry, 0, len(certEntries.m))
+	for _, entry := range certEntries.m {
+		entries = append(entries, entry)
+	}
+	certEntries.Unlock()
+	for _, entry := range entries {
+		entry.Refresh()
+	}
+}
+
+// pruneCertificates drops the entries gen no longer uses and resets the
+// hosts each remaining entry is validated against to the sites of gen.
+func pruneCertificates(gen *generation) {
+	hosts := make(map[cfgSslOpts]map[string]bool)
+	gen.cfg.Sites.Each(func(idx int, site *cfgSite) bool {
+		if site.SslOn && !site.SslOpts.Acme {
+			if hosts[*site.SslOpts] == nil {
+				hosts[*site.SslOpts] = make(map[string]bool)
+			}
+			if site.Host != "" {
+				hosts[*site.SslOpts][strings.ToLower(site.Host)] = true
+			}
+		}
+		return true
+	})
+	certEntries.Lock()
+	defer certEntries.Unlock()
+	for opts, entry := range certEntries.m {
+		if h, ok := hosts[opts]; ok {
+			entry.mu.Lock()
+			entry.hosts = h
+			entry.mu.Unlock()
+		} else {
+			delete(certEntries.m, opts)
+		}
+	}
+}
+
+// certStore holds the certificates of the ssl sites on one listener and
+// picks one per handshake by the server name the client sent (SNI).
+// Hosts of ssl_acme sites get theirs from the ACME manager.
+type certStore struct {
+	laddr     string
+	byOpts    map[cfgSslOpts]*certEntry
+	names     map[string]*certEntry
+	acme      *acmeManager
+	acmeHosts map[string]bool
+	hasDef    bool
+	def       *certEntry
+	defHost   string
+}
+
+// Add loads the certificate of site. The site's host always maps to its
+// own certificate; the other names in a certificate only fill names that
+// no site claimed. The first site on the listener, or the one marked
+// ssl_default, provides the certificate for clients without SNI.
+func (store *certStore) Add(site *cfgSite) error {
+	if site.SslOpts.Acme {
+		host := strings.ToLower(site.Host)
+		log.Printf("Adding Site Certificate: host=%s laddr=%s, acme=true", site.Host, store.laddr)
+		store.acmeHosts[host] = true
+		if !store.hasDef || site.SslOpts.Default {
+			store.hasDef = true
+			store.def, store.defHost = nil, host
+		}
+		return nil
+	}
+	entry, ok := store.byOpts[*site.SslOpts]
+	if !ok {
+		var err error
+		if entry, err = getCertEntry(site.SslOpts); err != nil {
+			return fmt.Errorf("site %s: %v", site.Host, err)
+		}
+		store.byOpts[*site.SslOpts] = entry
+		names := certNames(entry.Load().Leaf)
+		log.Printf("Adding Site Certificate: host=%s laddr=%s, names=%s", site.Host, store.laddr, strings.Join(names, ","))
+		for _, name := range names {
+			if _, ok := store.names[name]; !ok {
+				store.names[name] = entry
+			}
+		}
+	}
+	if site.Host != "" {
+		host := strings.ToLower(site.Host)
+		store.names[host] = entry
+		entry.mu.Lock()
+		entry.hosts[host] = true
+		entry.mu.Unlock()
+	}
+	if !store.hasDef || site.SslOpts.Default {
+		store.hasDef = true
+		store.def, store.defHost = entry, ""
+	}
+	return nil
+}
+
+func (store *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if store.acmeHosts[name] {
+			return store.acme.GetCertificate(hello)
+		}
+		if entry, ok := store.names[name]; ok {
+			return entry.Load(), nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if entry, ok := store.names["*"+name[i:]]; ok {
+				return entry.Load(), nil
+			}
+		}
+	}
+	if store.defHost != "" {
+		defHello := *hello
+		defHello.ServerName = store.defHost
+		return store.acme.GetCertificate(&defHello)
+	}
+	if store.def == nil {
+		return nil, errNoCertificate
+	}
+	return store.def.Load(), nil
+}
+
+func newCertStore(laddr string, acme *acmeManager) *certStore {
+	return &certStore{
+		laddr:     laddr,
+		byOpts:    make(map[cfgSslOpts]*certEntry),
+		names:     make(map[string]*certEntry),
+		acme:      acme,
+		acmeHosts: make(map[string]bool),
+	}
+}
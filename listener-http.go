@@ -4,76 +4,70 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"time"
+
+	"golang.org/x/net/http2/h2c"
 )
 
 type httpListener struct {
-	srv      *server
-	running  bool
+	handlerSwitch
+	listenerState
 	laddr    string
-	closing  chan bool
-	Closed   chan bool
+	http2    *cfgHttp2Opts
 	listener net.Listener
-	srvMux   *serveMux
+	server   *http.Server
 }
 
-func (lstnr *httpListener) AddSite(site *cfgSite) {
-	if lstnr.running {
-		return
-	}
-	if lstnr.srvMux == nil {
-		lstnr.srvMux = newServeMux()
-		addSite(lstnr.srv, lstnr.srvMux, lstnr.laddr, site, true)
-	} else {
-		addSite(lstnr.srv, lstnr.srvMux, lstnr.laddr, site, false)
-	}
+func (lstnr *httpListener) SetGeneration(gen *generation) {
+	lstnr.SetMux(gen, lstnr.laddr)
+}
+
+func (lstnr *httpListener) Compatible(site *cfgSite) bool {
+	return !site.SslOn && *site.Http2 == *lstnr.http2
+}
+
+func (lstnr *httpListener) Bind() (err error) {
+	lstnr.listener, err = listenTCP(lstnr.laddr, &lstnr.listenerState)
+	return
 }
 
 func (lstnr *httpListener) Open() {
-	if lstnr.running {
+	if !lstnr.start() {
 		return
 	}
-	lstnr.running = true
 	errch := make(chan error, 1)
+	if lstnr.http2.H2c {
+		lstnr.server.Handler = h2c.NewHandler(lstnr, newHttp2Server(lstnr.http2))
+	}
 	go func() {
-		var err error
-		lstnr.listener, err = net.Listen("tcp", lstnr.laddr)
-		if err != nil {
-			errch <- err
-		} else {
-			errch <- http.Serve(tcpKeepAliveListener{lstnr.listener.(*net.TCPListener)}, lstnr.srvMux)
-		}
+		errch <- lstnr.server.Serve(lstnr.listener)
 	}()
 	select {
 	case err := <-errch:
-		if err != nil && lstnr.running {
+		if err != nil && lstnr.IsOpen() {
 			log.Fatal(err)
 		}
 	case <-lstnr.closing:
 	}
 }
-func (lstnr *httpListener) Close() {
-	if !lstnr.running {
+func (lstnr *httpListener) Close(grace time.Duration) {
+	defer lstnr.done()
+	if !lstnr.stop() {
+		if lstnr.listener != nil {
+			lstnr.listener.Close()
+		}
 		return
 	}
 	lstnr.closing <- true
-	lstnr.running = false
-	lstnr.listener.Close()
-	lstnr.Closed <- true
-}
-func (lstnr *httpListener) IsOpen() bool {
-	return lstnr.running
-}
-func (lstnr *httpListener) ClosedCh() chan bool {
-	return lstnr.Closed
+	shutdownServer(lstnr.server, lstnr.laddr, grace)
 }
 
-func newHttpListener(srv *server, laddr string) (lstnr *httpListener) {
+func newHttpListener(laddr string, http2Opts *cfgHttp2Opts) (lstnr *httpListener) {
 	lstnr = &httpListener{
-		srv:     srv,
-		running: false,
-		laddr:   laddr,
-		closing: make(chan bool, 1),
-		Closed:  make(chan bool, 1),
+		listenerState: newListenerState(),
+		laddr:         laddr,
+		http2:         http2Opts,
 	}
+	lstnr.server = &http.Server{Addr: laddr, Handler: lstnr, ConnState: connStateCounter(laddr)}
 	return
 }
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
 )
 
 func cloneTLSConfig(cfg *tls.Config) *tls.Config {
@@ -47,143 +52,173 @@ func strSliceContains(ss []string, s string) bool {
 }
 
 type httpsListener struct {
-	srv      *server
-	running  bool
+	handlerSwitch
+	listenerState
 	laddr    string
-	sslOpts  *cfgSslOpts
-	closing  chan bool
-	Closed   chan bool
+	http2    *cfgHttp2Opts
+	http3    *cfgHttp3Opts
+	altSvc   atomic.Value
+	quic     *http3.Server
 	listener net.Listener
-	srvMux   *serveMux
+	server   *http.Server
 }
 
-func (lstnr *httpsListener) AddSite(site *cfgSite) {
-	if lstnr.running {
-		return
+func (lstnr *httpsListener) SetGeneration(gen *generation) {
+	lstnr.SetMux(gen, lstnr.laddr)
+}
+
+func (lstnr *httpsListener) Compatible(site *cfgSite) bool {
+	return site.SslOn && *site.Http2 == *lstnr.http2 && *site.Http3 == *lstnr.http3
+}
+
+// ServeHTTP advertises the HTTP/3 listener to clients on TCP.
+func (lstnr *httpsListener) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if altSvc := lstnr.altSvc.Load().(string); altSvc != "" && req.ProtoMajor < 3 {
+		rw.Header().Set("Alt-Svc", altSvc)
+	}
+	lstnr.handlerSwitch.ServeHTTP(rw, req)
+}
+
+// getCertificate picks the certificate from the sites of the current
+// generation, so that a reload brings in new certificates without
+// reopening the listener.
+func (lstnr *httpsListener) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	h := lstnr.current.Load().(*muxHandler)
+	if certs, ok := h.gen.certs[lstnr.laddr]; ok {
+		return certs.GetCertificate(hello)
+	}
+	return nil, errNoCertificate
+}
+
+// acmeConfig offers the TLS-ALPN-01 protocol to ACME validators, but only
+// while the listener has ssl_acme sites.
+func (lstnr *httpsListener) acmeConfig(cfg *tls.Config, hello *tls.ClientHelloInfo) *tls.Config {
+	if !strSliceContains(hello.SupportedProtos, acme.ALPNProto) {
+		return nil
+	}
+	h := lstnr.current.Load().(*muxHandler)
+	if certs, ok := h.gen.certs[lstnr.laddr]; !ok || len(certs.acmeHosts) == 0 {
+		return nil
 	}
-	if lstnr.srvMux == nil {
-		lstnr.srvMux = newServeMux()
-		addSite(lstnr.srv, lstnr.srvMux, lstnr.laddr, site, true)
+	acmeCfg := cloneTLSConfig(cfg)
+	acmeCfg.NextProtos = append([]string{acme.ALPNProto}, cfg.NextProtos...)
+	return acmeCfg
+}
+
+func (lstnr *httpsListener) Bind() error {
+	myTLSConfig := &tls.Config{
+		GetCertificate: lstnr.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+	}
+	myTLSConfig.PreferServerCipherSuites = true
+	lstnr.server.TLSConfig = myTLSConfig
+	if lstnr.http2.Enabled {
+		if err := http2.ConfigureServer(lstnr.server, newHttp2Server(lstnr.http2)); err != nil {
+			return err
+		}
 	} else {
-		addSite(lstnr.srv, lstnr.srvMux, lstnr.laddr, site, false)
+		lstnr.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	cfg := cloneTLSConfig(lstnr.server.TLSConfig)
+	if !strSliceContains(cfg.NextProtos, "http/1.1") {
+		cfg.NextProtos = append(cfg.NextProtos, "http/1.1")
+	}
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return lstnr.acmeConfig(cfg, hello), nil
 	}
+
+	ln, err := listenTCP(lstnr.laddr, &lstnr.listenerState)
+	if err != nil {
+		return err
+	}
+	lstnr.listener = tls.NewListener(ln, cfg)
+	return nil
 }
 
 func (lstnr *httpsListener) Open() {
-	if lstnr.running {
+	if !lstnr.start() {
 		return
 	}
-	lstnr.running = true
 	errch := make(chan error, 1)
-	go func() {
-		var err error
-		certPEMBlock := make([]byte, 0)
-		keyPEMBlock := make([]byte, 0)
-		if f := lstnr.sslOpts.Chain; f != "" {
-			if v, err := ioutil.ReadFile(f); err == nil {
-				certPEMBlock = append(certPEMBlock, v...)
-			} else {
-				log.Fatal(err)
-			}
-		}
-		if v, err := ioutil.ReadFile(lstnr.sslOpts.Cert); err == nil {
-			certPEMBlock = append(certPEMBlock, v...)
-		} else {
-			log.Fatal(err)
-		}
-		if v, err := ioutil.ReadFile(lstnr.sslOpts.Key); err == nil {
-			keyPEMBlock = append(keyPEMBlock, v...)
-		} else {
-			log.Fatal(err)
-		}
-		passphrase := lstnr.sslOpts.KeyPass
-		priv, _ := pem.Decode(keyPEMBlock)
-		if priv == nil {
-			log.Fatal("Key file error: no pem data")
-		}
-		if x509.IsEncryptedPEMBlock(priv) {
-			if passphrase == "" {
-				log.Fatal("Key file error: no pass phrase given")
+	if lstnr.quic != nil {
+		go func() {
+			err := lstnr.quic.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed && lstnr.IsOpen() {
+				log.Printf("HTTP/3 disabled: laddr=%s/udp err=%v", lstnr.laddr, err)
+				lstnr.altSvc.Store("")
 			}
-			b, err := x509.DecryptPEMBlock(priv, []byte(passphrase))
-			if err != nil {
-				log.Fatal(fmt.Sprintf("Key file error: %v", err))
-			}
-			keyPEMBlock = pem.EncodeToMemory(&pem.Block{
-				Type:  "RSA PRIVATE KEY",
-				Bytes: b,
-			})
-		} else if passphrase != "" {
-			log.Fatal("Key file error: invalid pass phrase given")
-		}
-		myCerts := make([]tls.Certificate, 1)
-		if myCerts[0], err = tls.X509KeyPair(certPEMBlock, keyPEMBlock); err != nil {
-			log.Fatal(err)
-		}
-		myTLSConfig := &tls.Config{
-			Certificates: myCerts,
-			MinVersion:   tls.VersionTLS12,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-			},
-		}
-		myTLSConfig.PreferServerCipherSuites = true
-		myTLSWebServer := &http.Server{Addr: lstnr.laddr, TLSConfig: myTLSConfig, Handler: lstnr.srvMux}
-
-		cfg := cloneTLSConfig(myTLSWebServer.TLSConfig)
-		if !strSliceContains(cfg.NextProtos, "http/1.1") {
-			cfg.NextProtos = append(cfg.NextProtos, "http/1.1")
-		}
-
-		lstnr.listener, err = net.Listen("tcp", lstnr.laddr)
-		if err != nil {
-			errch <- err
-		} else {
-			tlsListener := tls.NewListener(tcpKeepAliveListener{lstnr.listener.(*net.TCPListener)}, cfg)
-			errch <- myTLSWebServer.Serve(tlsListener)
-		}
+		}()
+	}
+	go func() {
+		errch <- lstnr.server.Serve(lstnr.listener)
 	}()
 	select {
 	case err := <-errch:
-		if err != nil && lstnr.running {
+		if err != nil && lstnr.IsOpen() {
 			log.Fatal(err)
 		}
 	case <-lstnr.closing:
 	}
 }
-func (lstnr *httpsListener) Close() {
-	if !lstnr.running {
+func (lstnr *httpsListener) Close(grace time.Duration) {
+	defer lstnr.done()
+	if !lstnr.stop() {
+		if lstnr.listener != nil {
+			lstnr.listener.Close()
+		}
 		return
 	}
 	lstnr.closing <- true
-	lstnr.running = false
-	lstnr.listener.Close()
-	lstnr.Closed <- true
-}
-func (lstnr *httpsListener) IsOpen() bool {
-	return lstnr.running
-}
-func (lstnr *httpsListener) ClosedCh() chan bool {
-	return lstnr.Closed
+	quicDone := make(chan bool)
+	go func() {
+		defer close(quicDone)
+		if lstnr.quic == nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if err := lstnr.quic.Shutdown(ctx); err != nil {
+			log.Printf("Listener shutdown timed out: laddr=%s/udp err=%v", lstnr.laddr, err)
+		}
+	}()
+	shutdownServer(lstnr.server, lstnr.laddr, grace)
+	<-quicDone
 }
 
-func newHttpsListener(srv *server, laddr string, sslOpts *cfgSslOpts) (lstnr *httpsListener) {
+func newHttpsListener(laddr string, http2Opts *cfgHttp2Opts, http3Opts *cfgHttp3Opts) (lstnr *httpsListener) {
 	lstnr = &httpsListener{
-		srv:     srv,
-		running: false,
-		laddr:   laddr,
-		sslOpts: sslOpts,
-		closing: make(chan bool, 1),
-		Closed:  make(chan bool, 1),
+		listenerState: newListenerState(),
+		laddr:         laddr,
+		http2:         http2Opts,
+		http3:         http3Opts,
+	}
+	lstnr.altSvc.Store("")
+	lstnr.server = &http.Server{Addr: laddr, Handler: lstnr, ConnState: connStateCounter(laddr), ErrorLog: newTlsErrorLog(laddr)}
+	if http3Opts.Enabled {
+		_, port := splitHostPort(laddr)
+		lstnr.altSvc.Store(fmt.Sprintf("h3=\":%s\"; ma=%d", port, int(http3Opts.MaxAge.Seconds())))
+		lstnr.quic = &http3.Server{
+			Addr:      laddr,
+			Handler:   lstnr,
+			TLSConfig: &tls.Config{GetCertificate: lstnr.getCertificate},
+			QUICConfig: &quic.Config{
+				MaxIncomingStreams: http3Opts.MaxConcurrentStreams,
+				MaxIdleTimeout:     http3Opts.IdleTimeout,
+			},
+		}
 	}
 	return
 }
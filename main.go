@@ -1,11 +1,16 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"syscall"
+	"time"
 )
 
 var sigdone chan bool
@@ -14,17 +19,125 @@ var majversion string
 var minversion string
 var builddate string
 
+var (
+	configFile  = flag.String("config", "config.yml", "path to the configuration file")
+	testConfig  = flag.Bool("test", false, "check the configuration and exit")
+	showVersion = flag.Bool("version", false, "print the version and exit")
+	pidFile     = flag.String("pidfile", "", "write the process id to this file")
+	logFile     = flag.String("log", "", "write the server log to this file instead of stderr")
+	logUTC      = flag.Bool("log-utc", false, "use UTC timestamps in the server log")
+	logMicro    = flag.Bool("log-micro", false, "use microsecond timestamps in the server log")
+	watch       = flag.Duration("watch", 2*time.Second, "poll the config and included files at this interval and reload on change, 0 to disable")
+	watchDelay  = flag.Duration("watch-delay", time.Second, "wait until watched files have been unchanged this long before reloading")
+	certCheck   = flag.Duration("cert-check", time.Minute, "reload changed certificate files and check their expiry at this interval, 0 to disable")
+)
+
+var serverLog *os.File
+
+func openServerLog() error {
+	flags := log.LstdFlags
+	if *logUTC {
+		flags |= log.LUTC
+	}
+	if *logMicro {
+		flags |= log.Lmicroseconds
+	}
+	log.SetFlags(flags)
+	if *logFile == "" || *logFile == "-" {
+		return nil
+	}
+	f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(f)
+	if serverLog != nil {
+		serverLog.Close()
+	}
+	serverLog = f
+	return nil
+}
+
+func writePidFile() {
+	if *pidFile == "" {
+		return
+	}
+	if err := ioutil.WriteFile(*pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		log.Fatalf("Pid file error: %v\n", err)
+	}
+}
+
+func removePidFile() {
+	if *pidFile != "" {
+		os.Remove(*pidFile)
+	}
+}
+
+func reloadConfig(srv *server, watcher *cfgWatcher) {
+	newCfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Printf("Config file error, keeping current config: %v\n", err)
+		return
+	}
+	if err := srv.Reload(newCfg); err != nil {
+		log.Printf("Config error, keeping current config: %v\n", err)
+		return
+	}
+	if watcher != nil {
+		watcher.Update(newCfg)
+	}
+}
+
 func main() {
+	flag.Parse()
+	if *showVersion {
+		fmt.Printf("gosimpleweb %s.%s (built %s)\n", majversion, minversion, builddate)
+		return
+	}
+	if err := openServerLog(); err != nil {
+		log.Fatalf("Log file error: %v\n", err)
+	}
+	if *testConfig {
+		cfg, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Config file error: %v\n", err)
+		}
+		if err := checkConfig(cfg); err != nil {
+			log.Fatalf("Config error: %v\n", err)
+		}
+		fmt.Printf("Config file %s is ok\n", *configFile)
+		return
+	}
 	log.Println("Go Simple Web Server")
 	log.Printf("Version: %s.%s", majversion, minversion)
 	log.Printf("Built: %s", builddate)
 	log.Println("Http server starting")
 	sigdone = make(chan bool, 1)
-	cfg := loadConfig()
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Config file error: %v\n", err)
+	}
+	writePidFile()
+	defer removePidFile()
 	runtime.GOMAXPROCS(runtime.NumCPU() * 4)
 	srv := newServer(cfg)
+	var watcher *cfgWatcher
+	var changed chan bool
+	if *watch > 0 {
+		watcher = newCfgWatcher(cfg, *watch, *watchDelay)
+		changed = watcher.Changed
+		go watcher.Watch()
+		defer watcher.Close()
+	}
+	var certTick <-chan time.Time
+	if *certCheck > 0 {
+		ticker := time.NewTicker(*certCheck)
+		defer ticker.Stop()
+		certTick = ticker.C
+	}
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	signal.Notify(sig, reopenSignals...)
 	running := true
 	signaled := false
 	for {
@@ -35,19 +148,31 @@ func main() {
 				return
 			}
 			srv.Start()
+		case <-changed:
+			log.Println("Config files changed")
+			reloadConfig(srv, watcher)
+		case <-certTick:
+			refreshCertificates()
 		case <-sigdone:
 			running = false
-			srv.Stop()
+			go srv.Stop()
 		case s := <-sig:
 			log.Println("Got signal:", s)
+			if isReopenSignal(s) {
+				if err := openServerLog(); err != nil {
+					log.Printf("Log file error: %v\n", err)
+				}
+				reopenAccessLogs()
+				break
+			}
 			if s == syscall.SIGHUP {
-				newCfg := loadConfig()
-				*cfg = *newCfg
-				srv.Stop()
+				refreshCertificates()
+				reloadConfig(srv, watcher)
 				break
 			}
 			if signaled {
 				log.Println("Force exit")
+				removePidFile()
 				os.Exit(137)
 				return
 			}
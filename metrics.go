@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var labelValueEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+
+func metricLabels(kv ...string) string {
+	ret := ""
+	for i := 0; i+1 < len(kv); i += 2 {
+		if ret != "" {
+			ret += ","
+		}
+		ret = fmt.Sprintf("%s%s=\"%s\"", ret, kv[i], labelValueEscaper.Replace(kv[i+1]))
+	}
+	return ret
+}
+
+func metricSeries(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return fmt.Sprintf("%s{%s}", name, labels)
+}
+
+type metricHistogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type metricFamily struct {
+	help   string
+	kind   string
+	values map[string]float64
+	hists  map[string]*metricHistogram
+}
+
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+func (reg *metricsRegistry) family(name, kind, help string) *metricFamily {
+	fam, ok := reg.families[name]
+	if !ok {
+		fam = &metricFamily{help: help, kind: kind, values: make(map[string]float64), hists: make(map[string]*metricHistogram)}
+		reg.families[name] = fam
+	}
+	return fam
+}
+
+func (reg *metricsRegistry) Add(name, help, labels string, v float64) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.family(name, "counter", help).values[labels] += v
+}
+
+func (reg *metricsRegistry) AddGauge(name, help, labels string, v float64) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.family(name, "gauge", help).values[labels] += v
+}
+
+func (reg *metricsRegistry) Observe(name, help, labels string, v float64) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	fam := reg.family(name, "histogram", help)
+	hist, ok := fam.hists[labels]
+	if !ok {
+		hist = &metricHistogram{counts: make([]uint64, len(durationBuckets))}
+		fam.hists[labels] = hist
+	}
+	for i, le := range durationBuckets {
+		if v <= le {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (reg *metricsRegistry) ObserveRequest(site, laddr string, entry *accessLogEntry) {
+	labels := metricLabels("site", site, "laddr", laddr)
+	reg.Add("gosimpleweb_requests_total", "Requests served per site and status code.", metricLabels("site", site, "laddr", laddr, "code", strconv.Itoa(entry.Status)), 1)
+	reg.Observe("gosimpleweb_request_duration_seconds", "Request latency per site.", labels, entry.Duration.Seconds())
+	reg.Add("gosimpleweb_response_bytes_total", "Response bytes sent per site.", labels, float64(entry.Bytes))
+}
+
+func writeMetricFamily(w io.Writer, name string, fam *metricFamily) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, fam.help, name, fam.kind)
+	if fam.kind == "histogram" {
+		keys := make([]string, 0, len(fam.hists))
+		for k := range fam.hists {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, labels := range keys {
+			hist := fam.hists[labels]
+			sep := ""
+			if labels != "" {
+				sep = ","
+			}
+			for i, le := range durationBuckets {
+				fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(le, 'g', -1, 64), hist.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, hist.count)
+			fmt.Fprintf(w, "%s %s\n", metricSeries(name+"_sum", labels), strconv.FormatFloat(hist.sum, 'g', -1, 64))
+			fmt.Fprintf(w, "%s %d\n", metricSeries(name+"_count", labels), hist.count)
+		}
+		return
+	}
+	keys := make([]string, 0, len(fam.values))
+	for k := range fam.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		fmt.Fprintf(w, "%s %s\n", metricSeries(name, labels), strconv.FormatFloat(fam.values[labels], 'g', -1, 64))
+	}
+}
+
+func (reg *metricsRegistry) WriteMetrics(w io.Writer) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	names := make([]string, 0, len(reg.families))
+	for name := range reg.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeMetricFamily(w, name, reg.families[name])
+	}
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{families: make(map[string]*metricFamily)}
+}
+
+var stats = newMetricsRegistry()
+
+// connStateCounter tracks open connections per listener through http.Server.ConnState.
+func connStateCounter(laddr string) func(net.Conn, http.ConnState) {
+	labels := metricLabels("laddr", laddr)
+	return func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			stats.AddGauge("gosimpleweb_listener_open_connections", "Open connections per listener.", labels, 1)
+		case http.StateClosed, http.StateHijacked:
+			stats.AddGauge("gosimpleweb_listener_open_connections", "Open connections per listener.", labels, -1)
+		}
+	}
+}
+
+// tlsErrorLog counts the TLS handshake errors net/http reports through
+// http.Server.ErrorLog before passing them on to the standard logger.
+type tlsErrorLog struct {
+	laddr string
+}
+
+func (w *tlsErrorLog) Write(b []byte) (int, error) {
+	if bytes.Contains(b, []byte("TLS handshake error")) {
+		stats.Add("gosimpleweb_tls_handshake_failures_total", "TLS handshake failures per listener.", metricLabels("laddr", w.laddr), 1)
+	}
+	log.Print(string(b))
+	return len(b), nil
+}
+
+func newTlsErrorLog(laddr string) *log.Logger {
+	return log.New(&tlsErrorLog{laddr: laddr}, "", 0)
+}
+
+type metricsListener struct {
+	laddr  string
+	path   string
+	gen    atomic.Value
+	server *http.Server
+}
+
+func (lstnr *metricsListener) SetGeneration(gen *generation) {
+	lstnr.gen.Store(gen)
+}
+
+func (lstnr *metricsListener) writeUpstreams(w io.Writer) {
+	gen, _ := lstnr.gen.Load().(*generation)
+	if gen == nil {
+		return
+	}
+	fam := &metricFamily{help: "Jobs waiting in the upstream worker queue.", kind: "gauge", values: make(map[string]float64)}
+	health := &metricFamily{help: "Upstream server health, 1 when healthy.", kind: "gauge", values: make(map[string]float64)}
+	active := &metricFamily{help: "Requests in flight per upstream server.", kind: "gauge", values: make(map[string]float64)}
+	for name, fcgi := range gen.fCgiClientsMap {
+		fam.values[metricLabels("type", "fcgi", "name", name)] = float64(len(fcgi.workerCh))
+		for _, node := range fcgi.balancer.nodes {
+			labels := metricLabels("type", "fcgi", "name", name, "server", node.server)
+			health.values[labels] = boolMetric(node.health.Healthy())
+			active.values[labels] = float64(node.Active())
+		}
+	}
+	for name, proxy := range gen.proxyClientsMap {
+		fam.values[metricLabels("type", "proxy", "name", name)] = float64(len(proxy.workerCh))
+		for _, node := range proxy.balancer.nodes {
+			labels := metricLabels("type", "proxy", "name", name, "server", node.server)
+			health.values[labels] = boolMetric(node.health.Healthy())
+			active.values[labels] = float64(node.Active())
+		}
+	}
+	writeMetricFamily(w, "gosimpleweb_upstream_queue_depth", fam)
+	writeMetricFamily(w, "gosimpleweb_upstream_healthy", health)
+	writeMetricFamily(w, "gosimpleweb_upstream_active_requests", active)
+}
+
+func (lstnr *metricsListener) writeCaches(w io.Writer) {
+	gen, _ := lstnr.gen.Load().(*generation)
+	if gen == nil || len(gen.caches) == 0 {
+		return
+	}
+	entries := &metricFamily{help: "Entries held per cache.", kind: "gauge", values: make(map[string]float64)}
+	size := &metricFamily{help: "Bytes held per cache.", kind: "gauge", values: make(map[string]float64)}
+	for name, zone := range gen.caches {
+		n, bytes := zone.store.Size()
+		entries.values[metricLabels("cache", name)] = float64(n)
+		size.values[metricLabels("cache", name)] = float64(bytes)
+	}
+	writeMetricFamily(w, "gosimpleweb_cache_entries", entries)
+	writeMetricFamily(w, "gosimpleweb_cache_bytes", size)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (lstnr *metricsListener) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != lstnr.path {
+		http.NotFound(rw, req)
+		return
+	}
+	var buf bytes.Buffer
+	stats.WriteMetrics(&buf)
+	lstnr.writeUpstreams(&buf)
+	lstnr.writeCaches(&buf)
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.Write(buf.Bytes())
+}
+
+func (lstnr *metricsListener) Compatible(cfg *cfgMetrics) bool {
+	return cfg != nil && cfg.Listen == lstnr.laddr && cfg.Path == lstnr.path
+}
+
+func (lstnr *metricsListener) Open() {
+	log.Printf("Starting Metrics: laddr=%s path=%s", lstnr.laddr, lstnr.path)
+	if err := lstnr.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("Metrics listener error: laddr=%s err=%v", lstnr.laddr, err)
+	}
+}
+
+func (lstnr *metricsListener) Close() {
+	lstnr.server.Close()
+}
+
+func newMetricsListener(cfg *cfgMetrics) (lstnr *metricsListener) {
+	lstnr = &metricsListener{
+		laddr: cfg.Listen,
+		path:  cfg.Path,
+	}
+	lstnr.server = &http.Server{Addr: cfg.Listen, Handler: lstnr}
+	return
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const (
+	defaultBodyBufferSize = 1 << 20
+	defaultSpoolMaxSize   = 32 << 20
+)
+
+var errRequestBodyTooLarge = errors.New("Request body too large")
+
+// limitedBody fails reads once more than max bytes have been read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (body *limitedBody) Read(b []byte) (n int, err error) {
+	if body.remaining < 0 {
+		return 0, errRequestBodyTooLarge
+	}
+	if int64(len(b)) > body.remaining+1 {
+		b = b[:body.remaining+1]
+	}
+	n, err = body.ReadCloser.Read(b)
+	body.remaining -= int64(n)
+	if body.remaining < 0 {
+		n += int(body.remaining)
+		err = errRequestBodyTooLarge
+	}
+	return
+}
+
+type bodyLimitHandler struct {
+	max  int64
+	next http.Handler
+}
+
+func (hndlr *bodyLimitHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.ContentLength > hndlr.max {
+		writeBodyTooLarge(rw)
+		return
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &limitedBody{ReadCloser: req.Body, remaining: hndlr.max}
+	}
+	hndlr.next.ServeHTTP(rw, req)
+}
+
+// clientBodyError marks a failure to read the request body from the client,
+// which says nothing about the health of the upstream it was sent to.
+type clientBodyError struct {
+	error
+}
+
+func (err clientBodyError) Unwrap() error {
+	return err.error
+}
+
+func isClientBodyError(err error) bool {
+	var bodyErr clientBodyError
+	return errors.As(err, &bodyErr)
+}
+
+// clientBody tags the read errors of a request body as clientBodyError.
+type clientBody struct {
+	io.ReadCloser
+}
+
+func (body clientBody) Read(b []byte) (n int, err error) {
+	n, err = body.ReadCloser.Read(b)
+	if err != nil && err != io.EOF {
+		err = clientBodyError{err}
+	}
+	return
+}
+
+func writeBodyTooLarge(rw http.ResponseWriter) {
+	rw.Header().Set("Connection", "close")
+	rw.WriteHeader(http.StatusRequestEntityTooLarge)
+	rw.Write([]byte("413: Request Entity Too Large"))
+}
+
+// spooledBody holds a request body of unknown length, in memory up to the
+// buffer size and in a temporary file beyond it.
+type spooledBody struct {
+	io.Reader
+	file *os.File
+}
+
+func (body *spooledBody) Close() error {
+	if body.file != nil {
+		body.file.Close()
+		os.Remove(body.file.Name())
+		body.file = nil
+	}
+	return nil
+}
+
+// spoolBody reads r into a spooledBody, failing with errRequestBodyTooLarge
+// once more than maxSize bytes have been read.
+func spoolBody(r io.Reader, bufferSize, maxSize int64) (body *spooledBody, size int64, err error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, bufferSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if n <= bufferSize {
+		return &spooledBody{Reader: &buf}, n, nil
+	}
+	f, err := ioutil.TempFile("", "gosimpleweb-body-")
+	if err != nil {
+		return nil, 0, err
+	}
+	body = &spooledBody{file: f}
+	if size, err = io.Copy(f, io.LimitReader(io.MultiReader(&buf, r), maxSize+1)); err == nil {
+		if size > maxSize {
+			err = errRequestBodyTooLarge
+		} else {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		body.Close()
+		return nil, 0, err
+	}
+	body.Reader = f
+	return
+}
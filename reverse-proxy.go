@@ -1,33 +1,146 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 )
 
 type proxyClientJob struct {
-	process func(proxy *httputil.ReverseProxy)
+	req     *http.Request
+	process func(up *proxyUpstream)
 }
 
-func (job *proxyClientJob) Run(proxy *httputil.ReverseProxy) {
-	job.process(proxy)
+func (job *proxyClientJob) Run(up *proxyUpstream) {
+	job.process(up)
+}
+
+type proxyUpstream struct {
+	server    string
+	serverUrl *url.URL
+	client    *httputil.ReverseProxy
+	health    *upstreamHealth
+}
+
+func (up *proxyUpstream) probe(opts *cfgHealthOpts) error {
+	if opts.Path == "" {
+		host := up.serverUrl.Host
+		if up.serverUrl.Port() == "" {
+			if up.serverUrl.Scheme == "https" {
+				host = net.JoinHostPort(up.serverUrl.Hostname(), "443")
+			} else {
+				host = net.JoinHostPort(up.serverUrl.Hostname(), "80")
+			}
+		}
+		conn, err := net.DialTimeout("tcp", host, opts.Timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+	probeUrl := *up.serverUrl
+	probeUrl.Path = strings.TrimRight(probeUrl.Path, "/") + opts.Path
+	client := &http.Client{Timeout: opts.Timeout}
+	resp, err := client.Get(probeUrl.String())
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if opts.ExpectStatus != 0 {
+		if resp.StatusCode != opts.ExpectStatus {
+			return fmt.Errorf("probe status %d", resp.StatusCode)
+		}
+	} else if resp.StatusCode >= 400 {
+		return fmt.Errorf("probe status %d", resp.StatusCode)
+	}
+	if opts.ExpectBody != "" && !strings.Contains(string(body), opts.ExpectBody) {
+		return fmt.Errorf("probe body %q", strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// isUpstreamError tells dial, timeout and I/O errors of the upstream
+// connection from client hang ups and request body errors.
+func isUpstreamError(err error) bool {
+	if isClientBodyError(err) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func newProxyUpstream(name, server string, serverUrl *url.URL, healthOpts *cfgHealthOpts) (up *proxyUpstream) {
+	up = &proxyUpstream{
+		server:    redactUrl(server),
+		serverUrl: serverUrl,
+		client:    httputil.NewSingleHostReverseProxy(serverUrl),
+	}
+	up.client.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode >= 500 {
+			up.health.Failure(fmt.Errorf("status %d", resp.StatusCode))
+		} else {
+			up.health.Success()
+		}
+		return nil
+	}
+	up.client.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		if req.Context().Err() == nil && isUpstreamError(err) {
+			up.health.Failure(err)
+		}
+		log.Println("proxy-err:", err)
+		if errors.Is(err, errRequestBodyTooLarge) {
+			writeBodyTooLarge(rw)
+		} else if isClientBodyError(err) {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("400: Bad Request"))
+		} else {
+			rw.WriteHeader(http.StatusBadGateway)
+			rw.Write([]byte("502: Bad Gateway"))
+		}
+	}
+	up.health = newUpstreamHealth("proxy", name, up.server, healthOpts, func() error {
+		return up.probe(healthOpts)
+	})
+	return
 }
 
 type proxyClients struct {
-	name     string
-	servers  cfgServerList
-	workerCh chan *proxyClientJob
-	closing  chan bool
+	name       string
+	servers    cfgServerList
+	healthOpts *cfgHealthOpts
+	upstreams  []*proxyUpstream
+	balancer   *upstreamBalancer
+	workerCh   chan *proxyClientJob
+	closing    chan bool
 }
 
-func (proxy *proxyClients) Start(client *httputil.ReverseProxy, id int) {
+func (proxy *proxyClients) Start() {
 	for {
 		select {
 		case job := <-proxy.workerCh:
+			idx, ok := proxy.balancer.Pick(job.req)
+			if !ok {
+				go job.Run(nil)
+				continue
+			}
+			up := proxy.upstreams[idx]
+			node := proxy.balancer.nodes[idx]
+			node.Acquire()
 			go func() {
-				job.Run(client)
+				defer node.Release()
+				job.Run(up)
 			}()
 		case <-proxy.closing:
 			return
@@ -35,40 +148,73 @@ func (proxy *proxyClients) Start(client *httputil.ReverseProxy, id int) {
 	}
 }
 
-func (proxy *proxyClients) Init() {
+func (proxy *proxyClients) Available() bool {
+	for _, up := range proxy.upstreams {
+		if up.health.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *proxyClients) Init(grp *cfgServerGroup) {
 	proxy.servers.Each(func(idx int, server string) bool {
 		if serverUrl, err := url.Parse(server); err == nil {
-			client := httputil.NewSingleHostReverseProxy(serverUrl)
-			log.Printf("Starting FCgi: name=%s server=%s", proxy.name, server)
-			go proxy.Start(client, idx)
+			up := newProxyUpstream(proxy.name, server, serverUrl, proxy.healthOpts)
+			log.Printf("Starting Proxy: name=%s server=%s weight=%d health=%s", proxy.name, up.server, grp.Weight(server), proxy.healthOpts)
+			proxy.upstreams = append(proxy.upstreams, up)
+			proxy.balancer.Add(&upstreamNode{server: up.server, weight: grp.Weight(server), health: up.health})
 		}
 		return true
 	})
+	log.Printf("Starting Proxy balancer: name=%s lb_policy=%s", proxy.name, proxy.balancer.policy)
+	go proxy.Start()
 }
 func (proxy *proxyClients) Kill() {
-	for _, _ = range proxy.servers {
-		proxy.closing <- true
+	proxy.closing <- true
+	for _, up := range proxy.upstreams {
+		up.health.Close()
 	}
 }
 
+func (proxy *proxyClients) writeUnavailable(rw http.ResponseWriter) {
+	rw.WriteHeader(http.StatusBadGateway)
+	rw.Write([]byte("502: Bad Gateway"))
+}
+
 func (proxy *proxyClients) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	respch := make(chan *httputil.ReverseProxy, 1)
+	if !proxy.Available() {
+		proxy.writeUnavailable(rw)
+		return
+	}
+	done := make(chan bool, 1)
 	proxy.workerCh <- &proxyClientJob{
-		process: func(proxy *httputil.ReverseProxy) {
-			respch <- proxy
+		req: req,
+		process: func(up *proxyUpstream) {
+			if up == nil {
+				proxy.writeUnavailable(rw)
+			} else {
+				setUpstream(req, proxy.name, up.server)
+				if req.Body != nil && req.Body != http.NoBody {
+					req.Body = clientBody{req.Body}
+				}
+				up.client.ServeHTTP(rw, req)
+			}
+			done <- true
 		},
 	}
-	client := <-respch
-	client.ServeHTTP(rw, req)
+	<-done
 }
 
-func newProxyClient(name string, servers cfgServerList) (proxy *proxyClients) {
+func newProxyClient(name string, grp *cfgServerGroup) (proxy *proxyClients) {
 	proxy = &proxyClients{
-		name:     name,
-		servers:  servers,
-		workerCh: make(chan *proxyClientJob, len(servers)*100),
-		closing:  make(chan bool, len(servers)),
+		name:       name,
+		servers:    grp.Servers,
+		healthOpts: grp.Health,
+		balancer:   newUpstreamBalancer(name, grp),
+		workerCh:   make(chan *proxyClientJob, len(grp.Servers)*100),
+		closing:    make(chan bool, 1),
 	}
-	proxy.Init()
+	proxy.Init(grp)
 	return
 }
@@ -93,16 +93,24 @@ func (mux *serveMux) match(host, path string) (h http.Handler, pattern string) {
 // If there is no registered handler that applies to the request,
 // Handler returns a ``page not found'' handler and an empty pattern.
 func (mux *serveMux) Handler(r *http.Request) (h http.Handler, pattern string) {
+	host := muxHost(r.Host)
 	if r.Method != "CONNECT" {
 		if p := cleanPath(r.URL.Path); p != r.URL.Path {
-			_, pattern = mux.handler(r.Host, p)
+			_, pattern = mux.handler(host, p)
 			url := *r.URL
 			url.Path = p
 			return http.RedirectHandler(url.String(), http.StatusMovedPermanently), pattern
 		}
 	}
 
-	return mux.handler(r.Host, r.URL.Path)
+	return mux.handler(host, r.URL.Path)
+}
+
+// muxHost is the form of a request's Host that site patterns are matched
+// against: as sent, port and case included. siteFor uses it too, so that
+// access logs, metrics and per-site options follow the site the mux picks.
+func muxHost(host string) string {
+	return host
 }
 
 // handler is the main implementation of Handler.
@@ -150,13 +158,19 @@ func (mux *serveMux) handle(pattern string, isRegexp bool, reHost string, handle
 	if handler == nil {
 		panic("http: nil handler")
 	}
-	if mux.m[pattern].explicit {
-		panic("http: multiple registrations for " + pattern)
+	key := pattern
+	if isRegexp {
+		// Regexp entries are keyed by host so the same pattern can be
+		// registered for several hosts on one listener.
+		key = reHost + pattern
+	}
+	if mux.m[key].explicit {
+		panic("http: multiple registrations for " + key)
 	}
 
 	if isRegexp {
 		if re, err := regexp.Compile(pattern); err == nil {
-			mux.m[pattern] = muxEntry{explicit: true, regexp: true, h: handler, reHost: reHost, rePattern: re}
+			mux.m[key] = muxEntry{explicit: true, regexp: true, h: handler, reHost: reHost, rePattern: re}
 		} else {
 			panic("http: match handler regexp error: " + err.Error())
 		}
@@ -1,82 +1,430 @@
 package main
 
-type server struct {
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type generation struct {
 	cfg             *config
-	running         bool
 	fCgiClientsMap  map[string]*fCgiClients
 	proxyClientsMap map[string]*proxyClients
-	listeners       map[string]listener
-	Stopped         chan bool
+	upstreams       []*upstreamRef
+	muxes           map[string]*serveMux
+	sites           map[string]*cfgSite
+	hosts           map[string]map[string]*cfgSite
+	accessLogs      map[*cfgSite]*accessLogger
+	caches          map[string]*cacheZone
+	certs           map[string]*certStore
+	acme            *acmeManager
+	mu              sync.Mutex
+	active          int
+	retired         bool
+	drained         chan bool
 }
 
-func (srv *server) GetCfg() *config {
-	return srv.cfg
+func (gen *generation) GetCfg() *config {
+	return gen.cfg
 }
-func (srv *server) GetFcgi(name string) (client *fCgiClients, ok bool) {
-	client, ok = srv.fCgiClientsMap[name]
+func (gen *generation) GetFcgi(name string) (client *fCgiClients, ok bool) {
+	client, ok = gen.fCgiClientsMap[name]
 	return
 }
-func (srv *server) GetProxy(name string) (client *proxyClients, ok bool) {
-	client, ok = srv.proxyClientsMap[name]
+func (gen *generation) GetProxy(name string) (client *proxyClients, ok bool) {
+	client, ok = gen.proxyClientsMap[name]
+	return
+}
+func (gen *generation) GetCache(name string) (zone *cacheZone, ok bool) {
+	zone, ok = gen.caches[name]
 	return
 }
 
-func (srv *server) Start() {
-	if srv.running {
+func (gen *generation) Acquire() bool {
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	if gen.retired {
+		return false
+	}
+	gen.active++
+	return true
+}
+func (gen *generation) Release() {
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	gen.active--
+	if gen.retired && gen.active == 0 {
+		close(gen.drained)
+	}
+}
+
+// Retire stops the generation from taking new requests and returns a
+// channel that is closed once its in-flight requests have finished.
+func (gen *generation) Retire() chan bool {
+	gen.mu.Lock()
+	defer gen.mu.Unlock()
+	if !gen.retired {
+		gen.retired = true
+		if gen.active == 0 {
+			close(gen.drained)
+		}
+	}
+	return gen.drained
+}
+
+func (gen *generation) Kill() {
+	for _, ref := range gen.upstreams {
+		releaseUpstream(ref)
+	}
+	for _, logger := range gen.accessLogs {
+		logger.Close()
+	}
+	for _, zone := range gen.caches {
+		zone.Close()
+	}
+}
+
+func (gen *generation) addAccessLog(site *cfgSite) error {
+	cfg := site.AccessLog
+	if cfg == nil {
+		cfg = gen.cfg.AccessLog
+	}
+	if cfg == nil || cfg.File == "" {
+		return nil
+	}
+	logger, err := newAccessLogger(cfg)
+	if err != nil {
+		return fmt.Errorf("site %s: %v", site.Host, err)
+	}
+	gen.accessLogs[site] = logger
+	return nil
+}
+
+// siteFor returns the site on laddr serving host, falling back to the
+// listener's default site.
+func (gen *generation) siteFor(laddr, host string) *cfgSite {
+	if site, ok := gen.hosts[laddr][muxHost(host)]; ok {
+		return site
+	}
+	return gen.sites[laddr]
+}
+
+func (gen *generation) build() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	gen.cfg.Sites.Each(func(idx int, site *cfgSite) bool {
+		if site.SslOn && site.SslOpts.Acme && gen.acme == nil {
+			acmeOpts := gen.cfg.Acme
+			if acmeOpts == nil {
+				acmeOpts = newAcmeOpts()
+			}
+			if gen.acme, err = getAcmeManager(acmeOpts); err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
 		return
 	}
-	srv.cfg.FCgiServers.Each(func(label string, lst cfgServerList) bool {
-		srv.fCgiClientsMap[label] = newFcgiClient(label, lst)
+	gen.cfg.Sites.Each(func(idx int, site *cfgSite) bool {
+		laddr := site.Addr()
+		mux, ok := gen.muxes[laddr]
+		if ok {
+			addSite(gen, mux, laddr, site, false)
+		} else {
+			mux = newServeMux()
+			addSite(gen, mux, laddr, site, true)
+			gen.muxes[laddr] = mux
+			gen.sites[laddr] = site
+			gen.hosts[laddr] = make(map[string]*cfgSite)
+		}
+		if _, ok := gen.hosts[laddr][site.Host]; !ok {
+			gen.hosts[laddr][site.Host] = site
+		}
+		if site.SslOn {
+			certs, ok := gen.certs[laddr]
+			if !ok {
+				certs = newCertStore(laddr, gen.acme)
+				gen.certs[laddr] = certs
+			}
+			if err = certs.Add(site); err != nil {
+				return false
+			}
+		}
+		err = gen.addAccessLog(site)
+		return err == nil
+	})
+	return
+}
+
+type upstreamClients interface {
+	Kill()
+}
+
+type upstreamRef struct {
+	id      string
+	grp     *cfgServerGroup
+	clients upstreamClients
+	refs    int
+}
+
+var upstreamRefs = struct {
+	sync.Mutex
+	m map[string]*upstreamRef
+}{m: make(map[string]*upstreamRef)}
+
+// acquireUpstream shares fcgi and proxy client groups between configuration
+// generations so a reload keeps the pooled connections and health state of
+// the groups whose configuration did not change.
+func acquireUpstream(id string, grp *cfgServerGroup, create func() upstreamClients) *upstreamRef {
+	upstreamRefs.Lock()
+	defer upstreamRefs.Unlock()
+	ref := upstreamRefs.m[id]
+	if ref == nil || !reflect.DeepEqual(ref.grp, grp) {
+		ref = &upstreamRef{id: id, grp: grp, clients: create()}
+		upstreamRefs.m[id] = ref
+	}
+	ref.refs++
+	return ref
+}
+
+func releaseUpstream(ref *upstreamRef) {
+	upstreamRefs.Lock()
+	defer upstreamRefs.Unlock()
+	ref.refs--
+	if ref.refs <= 0 {
+		if upstreamRefs.m[ref.id] == ref {
+			delete(upstreamRefs.m, ref.id)
+		}
+		ref.clients.Kill()
+	}
+}
+
+func newGeneration(cfg *config) (gen *generation, err error) {
+	gen = &generation{
+		cfg:             cfg,
+		fCgiClientsMap:  make(map[string]*fCgiClients),
+		proxyClientsMap: make(map[string]*proxyClients),
+		muxes:           make(map[string]*serveMux),
+		sites:           make(map[string]*cfgSite),
+		hosts:           make(map[string]map[string]*cfgSite),
+		accessLogs:      make(map[*cfgSite]*accessLogger),
+		caches:          make(map[string]*cacheZone),
+		certs:           make(map[string]*certStore),
+		drained:         make(chan bool),
+	}
+	cfg.FCgiServers.Each(func(label string, grp *cfgServerGroup) bool {
+		ref := acquireUpstream("fcgi:"+label, grp, func() upstreamClients {
+			return newFcgiClient(label, grp)
+		})
+		gen.upstreams = append(gen.upstreams, ref)
+		gen.fCgiClientsMap[label] = ref.clients.(*fCgiClients)
 		return true
 	})
-	srv.cfg.ProxyServers.Each(func(label string, lst cfgServerList) bool {
-		srv.proxyClientsMap[label] = newProxyClient(label, lst)
+	cfg.ProxyServers.Each(func(label string, grp *cfgServerGroup) bool {
+		ref := acquireUpstream("proxy:"+label, grp, func() upstreamClients {
+			return newProxyClient(label, grp)
+		})
+		gen.upstreams = append(gen.upstreams, ref)
+		gen.proxyClientsMap[label] = ref.clients.(*proxyClients)
 		return true
 	})
-	srv.cfg.Sites.Each(func(idx int, site *cfgSite) bool {
-		laddr := site.Addr()
-		if lstnr, ok := srv.listeners[laddr]; ok {
-			lstnr.AddSite(site)
+	cfg.Caches.Each(func(name string, cacheOpts *cfgCacheOpts) bool {
+		var zone *cacheZone
+		if zone, err = newCacheZone(name, cacheOpts); err == nil {
+			gen.caches[name] = zone
+		}
+		return err == nil
+	})
+	if err == nil {
+		err = gen.build()
+	}
+	if err != nil {
+		gen.Kill()
+		gen = nil
+	}
+	return
+}
+
+type server struct {
+	mu        sync.Mutex
+	cfg       *config
+	running   bool
+	gen       *generation
+	listeners map[string]listener
+	drains    sync.WaitGroup
+	metrics   *metricsListener
+	Stopped   chan bool
+}
+
+func (srv *server) GetCfg() *config {
+	return srv.cfg
+}
+
+// apply binds the addresses that are not served yet before it changes
+// anything, so that a bind error keeps the running configuration. Replaced
+// listeners give up their socket right away and drain in the background.
+func (srv *server) apply(gen *generation) error {
+	opening := make(map[string]listener)
+	for laddr, site := range gen.sites {
+		if lstnr, ok := srv.listeners[laddr]; ok && lstnr.Compatible(site) {
+			continue
+		}
+		if site.SslOn {
+			opening[laddr] = newHttpsListener(laddr, site.Http2, site.Http3)
 		} else {
-			if site.SslOn {
-				lstnr = newHttpsListener(srv, laddr, site.SslOpts)
-			} else {
-				lstnr = newHttpListener(srv, laddr)
+			opening[laddr] = newHttpListener(laddr, site.Http2)
+		}
+	}
+	for laddr, lstnr := range opening {
+		if _, ok := srv.listeners[laddr]; ok {
+			continue
+		}
+		if err := lstnr.Bind(); err != nil {
+			for _, lstnr := range opening {
+				lstnr.Close(0)
 			}
-			lstnr.AddSite(site)
+			return err
+		}
+	}
+	setAcmeHosts(gen)
+	for laddr, lstnr := range srv.listeners {
+		if site, ok := gen.sites[laddr]; !ok || !lstnr.Compatible(site) {
+			log.Printf("Closing listener: laddr=%s", laddr)
+			srv.drain(lstnr, gen.cfg.ShutdownTimeout)
+			<-lstnr.ReleasedCh()
+			delete(srv.listeners, laddr)
+			if lstnr, ok := opening[laddr]; ok {
+				if err := lstnr.Bind(); err != nil {
+					log.Printf("Listener error: laddr=%s err=%v", laddr, err)
+					lstnr.Close(0)
+					delete(opening, laddr)
+				}
+			}
+		}
+	}
+	for laddr := range gen.muxes {
+		if lstnr, ok := srv.listeners[laddr]; ok {
+			lstnr.SetGeneration(gen)
+		} else if lstnr, ok := opening[laddr]; ok {
+			lstnr.SetGeneration(gen)
 			srv.listeners[laddr] = lstnr
+			go lstnr.Open()
+		}
+	}
+	if srv.metrics != nil && !srv.metrics.Compatible(gen.cfg.Metrics) {
+		srv.metrics.Close()
+		srv.metrics = nil
+	}
+	if srv.metrics == nil && gen.cfg.Metrics != nil && gen.cfg.Metrics.Listen != "" {
+		srv.metrics = newMetricsListener(gen.cfg.Metrics)
+		go srv.metrics.Open()
+	}
+	if srv.metrics != nil {
+		srv.metrics.SetGeneration(gen)
+	}
+	old := srv.gen
+	srv.gen = gen
+	pruneCertificates(gen)
+	if old != nil {
+		go func() {
+			<-old.Retire()
+			old.Kill()
+			log.Println("Previous configuration drained")
+		}()
+	}
+	return nil
+}
+
+// drain closes lstnr in the background; Stop waits for it.
+func (srv *server) drain(lstnr listener, grace time.Duration) {
+	srv.drains.Add(1)
+	go func() {
+		defer srv.drains.Done()
+		lstnr.Close(grace)
+	}()
+}
+
+func (srv *server) Start() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.running {
+		return
+	}
+	gen, err := newGeneration(srv.cfg)
+	if err == nil {
+		if err = srv.apply(gen); err != nil {
+			gen.Kill()
 		}
-		return true
-	})
-	for _, lstnr := range srv.listeners {
-		go lstnr.Open()
+	}
+	if err != nil {
+		log.Fatalf("Config error: %v\n", err)
 	}
 	srv.running = true
 }
+
+func (srv *server) Reload(cfg *config) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.running {
+		srv.cfg = cfg
+		return nil
+	}
+	gen, err := newGeneration(cfg)
+	if err != nil {
+		return err
+	}
+	if err = srv.apply(gen); err != nil {
+		gen.Kill()
+		return err
+	}
+	srv.cfg = cfg
+	log.Println("Config reloaded")
+	return nil
+}
+
 func (srv *server) Stop() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
 	if !srv.running {
 		return
 	}
 	srv.running = false
+	grace := srv.cfg.ShutdownTimeout
+	log.Printf("Http server draining: grace=%s", grace)
 	for _, lstnr := range srv.listeners {
-		go lstnr.Close()
-		<-lstnr.ClosedCh()
+		srv.drain(lstnr, grace)
 	}
+	srv.drains.Wait()
 	srv.listeners = make(map[string]listener)
-	for _, fcgi := range srv.fCgiClientsMap {
-		fcgi.Kill()
+	if srv.metrics != nil {
+		srv.metrics.Close()
+		srv.metrics = nil
+	}
+	if srv.gen != nil {
+		select {
+		case <-srv.gen.Retire():
+		case <-time.After(grace):
+			log.Println("Http server drain timed out")
+		}
+		srv.gen.Kill()
+		srv.gen = nil
 	}
-	srv.fCgiClientsMap = make(map[string]*fCgiClients)
 	srv.Stopped <- true
 }
 
 func newServer(cfg *config) (srv *server) {
 	srv = &server{
-		cfg:            cfg,
-		running:        false,
-		fCgiClientsMap: make(map[string]*fCgiClients),
-		listeners:      make(map[string]listener),
-		Stopped:        make(chan bool, 1),
+		cfg:       cfg,
+		running:   false,
+		listeners: make(map[string]listener),
+		Stopped:   make(chan bool, 1),
 	}
 	go srv.Start()
 	return
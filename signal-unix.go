@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
+
+func isReopenSignal(s os.Signal) bool {
+	return s == syscall.SIGUSR1
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+var reopenSignals = []os.Signal{}
+
+func isReopenSignal(s os.Signal) bool {
+	return false
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const tryFilesKey ctxKey = 1
+
+// staticHandler serves the files below a site root with configurable
+// index files, directory listings, hidden file denial and try_files.
+type staticHandler struct {
+	root     http.Dir
+	opts     *cfgStaticOpts
+	compress *cfgCompressOpts
+	mux      *serveMux
+}
+
+func isHidden(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != ".well-known" {
+			return true
+		}
+	}
+	return false
+}
+
+func (hndlr *staticHandler) stat(name string) (os.FileInfo, bool) {
+	if hndlr.opts.DenyHidden && isHidden(name) {
+		return nil, false
+	}
+	f, err := hndlr.root.Open(name)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	return fi, err == nil
+}
+
+// escapePath escapes each segment of p so it can be parsed as a URL.
+func escapePath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		segs[i] = url.PathEscape(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+func (hndlr *staticHandler) expand(entry, uri string, req *http.Request) string {
+	return strings.NewReplacer("$uri", uri, "$query", req.URL.RawQuery, "$args", req.URL.RawQuery).Replace(entry)
+}
+
+func (hndlr *staticHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	name := path.Clean("/" + req.URL.Path)
+	if hndlr.opts.DenyHidden && isHidden(name) {
+		http.NotFound(rw, req)
+		return
+	}
+	if len(hndlr.opts.TryFiles) == 0 || req.Context().Value(tryFilesKey) != nil {
+		hndlr.serve(rw, req, name)
+		return
+	}
+	last := len(hndlr.opts.TryFiles) - 1
+	for _, entry := range hndlr.opts.TryFiles[:last] {
+		try := path.Clean("/" + hndlr.expand(entry, req.URL.Path, req))
+		if fi, ok := hndlr.stat(try); ok && fi.IsDir() == strings.HasSuffix(entry, "/") {
+			hndlr.serve(rw, req, try)
+			return
+		}
+	}
+	fallback := hndlr.expand(hndlr.opts.TryFiles[last], escapePath(req.URL.Path), req)
+	if strings.HasPrefix(fallback, "=") {
+		code, _ := strconv.Atoi(fallback[1:])
+		http.Error(rw, fmt.Sprintf("%d: %s", code, http.StatusText(code)), code)
+		return
+	}
+	target, err := url.Parse(fallback)
+	if err != nil {
+		http.NotFound(rw, req)
+		return
+	}
+	r2 := req.WithContext(context.WithValue(req.Context(), tryFilesKey, true))
+	u := *req.URL
+	u.Path = target.Path
+	u.RawPath = ""
+	u.RawQuery = target.RawQuery
+	r2.URL = &u
+	hndlr.mux.ServeHTTP(rw, r2)
+}
+
+func (hndlr *staticHandler) serve(rw http.ResponseWriter, req *http.Request, name string) {
+	f, err := hndlr.root.Open(name)
+	if err != nil {
+		if os.IsPermission(err) {
+			http.Error(rw, "403: Forbidden", http.StatusForbidden)
+		} else {
+			http.NotFound(rw, req)
+		}
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.NotFound(rw, req)
+		return
+	}
+	if !fi.IsDir() {
+		hndlr.serveContent(rw, req, name, fi, f)
+		return
+	}
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		target := path.Base(req.URL.Path) + "/"
+		if req.URL.RawQuery != "" {
+			target += "?" + req.URL.RawQuery
+		}
+		http.Redirect(rw, req, target, http.StatusMovedPermanently)
+		return
+	}
+	for _, index := range hndlr.opts.Index {
+		if idx, err := hndlr.root.Open(path.Join(name, index)); err == nil {
+			if ifi, err := idx.Stat(); err == nil && !ifi.IsDir() {
+				hndlr.serveContent(rw, req, path.Join(name, index), ifi, idx)
+				idx.Close()
+				return
+			}
+			idx.Close()
+		}
+	}
+	if !hndlr.opts.Autoindex {
+		http.Error(rw, "403: Forbidden", http.StatusForbidden)
+		return
+	}
+	hndlr.list(rw, f)
+}
+
+// serveContent serves a precompressed .br or .gz sibling of the file in
+// its place when the client accepts that encoding.
+func (hndlr *staticHandler) serveContent(rw http.ResponseWriter, req *http.Request, name string, fi os.FileInfo, f http.File) {
+	if hndlr.compress != nil && hndlr.compress.Precompressed {
+		var encodings []string
+		for _, enc := range hndlr.compress.Encodings {
+			if _, ok := precompressedExts[enc]; ok {
+				encodings = append(encodings, enc)
+			}
+		}
+		ctype := mime.TypeByExtension(path.Ext(name))
+		if ctype != "" && compressibleType(hndlr.compress.Types, ctype) {
+			addVary(rw.Header(), "Accept-Encoding")
+			if enc := negotiateEncoding(req, encodings); enc != "" {
+				if pf, err := hndlr.root.Open(name + precompressedExts[enc]); err == nil {
+					defer pf.Close()
+					if pfi, err := pf.Stat(); err == nil && !pfi.IsDir() {
+						rw.Header().Set("Content-Type", ctype)
+						rw.Header().Set("Content-Encoding", enc)
+						http.ServeContent(rw, req, fi.Name(), pfi.ModTime(), pf)
+						return
+					}
+				}
+			}
+		}
+	}
+	http.ServeContent(rw, req, fi.Name(), fi.ModTime(), f)
+}
+
+func (hndlr *staticHandler) list(rw http.ResponseWriter, f http.File) {
+	entries, err := f.Readdir(-1)
+	if err != nil {
+		http.Error(rw, "500: Error reading directory", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(rw, "<pre>\n")
+	for _, fi := range entries {
+		name := fi.Name()
+		if hndlr.opts.DenyHidden && isHidden(name) {
+			continue
+		}
+		if fi.IsDir() {
+			name += "/"
+		}
+		link := url.URL{Path: name}
+		fmt.Fprintf(rw, "<a href=\"%s\">%s</a>\n", link.String(), html.EscapeString(name))
+	}
+	fmt.Fprintf(rw, "</pre>\n")
+}
+
+func newStaticHandler(site *cfgSite, mux *serveMux) *staticHandler {
+	opts := site.Static
+	if opts == nil {
+		opts = newStaticOpts()
+	}
+	return &staticHandler{root: http.Dir(site.Root), opts: opts, compress: site.Compress, mux: mux}
+}
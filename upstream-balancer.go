@@ -0,0 +1,193 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	lbRoundRobin         = "round_robin"
+	lbWeightedRoundRobin = "weighted_round_robin"
+	lbLeastConn          = "least_conn"
+	lbRandomTwo          = "random_two"
+	lbHash               = "hash"
+)
+
+var lbPolicies = []string{lbRoundRobin, lbWeightedRoundRobin, lbLeastConn, lbRandomTwo, lbHash}
+
+type upstreamNode struct {
+	server  string
+	weight  int
+	health  *upstreamHealth
+	active  int64
+	current int
+}
+
+func (node *upstreamNode) Acquire() {
+	atomic.AddInt64(&node.active, 1)
+}
+
+func (node *upstreamNode) Release() {
+	atomic.AddInt64(&node.active, -1)
+}
+
+func (node *upstreamNode) Active() int64 {
+	return atomic.LoadInt64(&node.active)
+}
+
+type ringPoint struct {
+	hash uint32
+	idx  int
+}
+
+type upstreamBalancer struct {
+	name    string
+	policy  string
+	hashKey string
+	nodes   []*upstreamNode
+	ring    []ringPoint
+	mu      sync.Mutex
+	next    int
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func (lb *upstreamBalancer) Add(node *upstreamNode) {
+	if node.weight < 1 {
+		node.weight = 1
+	}
+	lb.nodes = append(lb.nodes, node)
+	idx := len(lb.nodes) - 1
+	for i := 0; i < node.weight*100; i++ {
+		lb.ring = append(lb.ring, ringPoint{hash: hashString(node.server + "#" + strconv.Itoa(i)), idx: idx})
+	}
+	sort.Slice(lb.ring, func(i, j int) bool {
+		return lb.ring[i].hash < lb.ring[j].hash
+	})
+}
+
+func (lb *upstreamBalancer) healthy() []int {
+	lst := make([]int, 0, len(lb.nodes))
+	for idx, node := range lb.nodes {
+		if node.health.Healthy() {
+			lst = append(lst, idx)
+		}
+	}
+	return lst
+}
+
+func (lb *upstreamBalancer) key(req *http.Request) string {
+	if req != nil {
+		if strings.HasPrefix(lb.hashKey, "cookie:") {
+			if c, err := req.Cookie(lb.hashKey[7:]); err == nil && c.Value != "" {
+				return c.Value
+			}
+		} else if strings.HasPrefix(lb.hashKey, "header:") {
+			if v := req.Header.Get(lb.hashKey[7:]); v != "" {
+				return v
+			}
+		}
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			return host
+		}
+		return req.RemoteAddr
+	}
+	return ""
+}
+
+// Pick returns the index of the node that should serve req, or false when no node is healthy.
+func (lb *upstreamBalancer) Pick(req *http.Request) (int, bool) {
+	lst := lb.healthy()
+	if len(lst) == 0 {
+		return 0, false
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	switch lb.policy {
+	case lbWeightedRoundRobin:
+		total := 0
+		best := -1
+		for _, idx := range lst {
+			node := lb.nodes[idx]
+			node.current += node.weight
+			total += node.weight
+			if best < 0 || node.current > lb.nodes[best].current {
+				best = idx
+			}
+		}
+		lb.nodes[best].current -= total
+		return best, true
+	case lbLeastConn:
+		lb.next++
+		best := -1
+		for i := range lst {
+			idx := lst[(lb.next+i)%len(lst)]
+			node := lb.nodes[idx]
+			if best < 0 || node.Active()*int64(lb.nodes[best].weight) < lb.nodes[best].Active()*int64(node.weight) {
+				best = idx
+			}
+		}
+		return best, true
+	case lbRandomTwo:
+		if len(lst) == 1 {
+			return lst[0], true
+		}
+		i := rand.Intn(len(lst))
+		j := rand.Intn(len(lst) - 1)
+		if j >= i {
+			j++
+		}
+		a, b := lb.nodes[lst[i]], lb.nodes[lst[j]]
+		if b.Active()*int64(a.weight) < a.Active()*int64(b.weight) {
+			return lst[j], true
+		}
+		return lst[i], true
+	case lbHash:
+		h := hashString(lb.key(req))
+		start := sort.Search(len(lb.ring), func(i int) bool {
+			return lb.ring[i].hash >= h
+		})
+		for i := 0; i < len(lb.ring); i++ {
+			point := lb.ring[(start+i)%len(lb.ring)]
+			if lb.nodes[point.idx].health.Healthy() {
+				return point.idx, true
+			}
+		}
+		return 0, false
+	default:
+		lb.next++
+		return lst[lb.next%len(lst)], true
+	}
+}
+
+func newUpstreamBalancer(name string, grp *cfgServerGroup) (lb *upstreamBalancer) {
+	policy := grp.LbPolicy
+	if policy == "" {
+		policy = lbRoundRobin
+	} else if !strSliceContains(lbPolicies, policy) {
+		log.Printf("Unknown lb_policy: name=%s lb_policy=%s, using %s", name, policy, lbRoundRobin)
+		policy = lbRoundRobin
+	}
+	hashKey := grp.LbHashKey
+	if hashKey == "" {
+		hashKey = "ip"
+	}
+	lb = &upstreamBalancer{
+		name:    name,
+		policy:  policy,
+		hashKey: hashKey,
+	}
+	return
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testBalancer(policy string, weights ...int) *upstreamBalancer {
+	lb := newUpstreamBalancer("test", &cfgServerGroup{LbPolicy: policy})
+	for idx, weight := range weights {
+		lb.Add(&upstreamNode{
+			server: "10.0.0." + strconv.Itoa(idx+1) + ":9000",
+			weight: weight,
+			health: &upstreamHealth{opts: &cfgHealthOpts{}, healthy: true},
+		})
+	}
+	return lb
+}
+
+// eject marks a node unhealthy until well after the test ends.
+func eject(node *upstreamNode) {
+	node.health.healthy = false
+	node.health.ejectedUntil = time.Now().Add(time.Hour)
+}
+
+func pickCounts(t *testing.T, lb *upstreamBalancer, n int, req *http.Request) []int {
+	counts := make([]int, len(lb.nodes))
+	for i := 0; i < n; i++ {
+		idx, ok := lb.Pick(req)
+		if !ok {
+			t.Fatalf("pick %d failed", i)
+		}
+		counts[idx]++
+	}
+	return counts
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	lb := testBalancer("", 1, 1, 1)
+	if lb.policy != lbRoundRobin {
+		t.Fatalf("default policy = %s", lb.policy)
+	}
+	for idx, n := range pickCounts(t, lb, 30, nil) {
+		if n != 10 {
+			t.Errorf("node %d picked %d times, want 10", idx, n)
+		}
+	}
+}
+
+func TestBalancerWeightedRoundRobin(t *testing.T) {
+	lb := testBalancer(lbWeightedRoundRobin, 5, 1, 1)
+	counts := pickCounts(t, lb, 70, nil)
+	if counts[0] != 50 || counts[1] != 10 || counts[2] != 10 {
+		t.Errorf("counts = %v, want [50 10 10]", counts)
+	}
+	// The heavy node is spread out rather than picked five times in a row.
+	lb = testBalancer(lbWeightedRoundRobin, 5, 1, 1)
+	run := 0
+	for i := 0; i < 7; i++ {
+		if idx, _ := lb.Pick(nil); idx == 0 {
+			if run++; run > 3 {
+				t.Fatal("node 0 picked more than 3 times in a row")
+			}
+		} else {
+			run = 0
+		}
+	}
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	lb := testBalancer(lbLeastConn, 1, 1, 1)
+	lb.nodes[0].Acquire()
+	lb.nodes[2].Acquire()
+	lb.nodes[2].Acquire()
+	for i := 0; i < 5; i++ {
+		if idx, _ := lb.Pick(nil); idx != 1 {
+			t.Fatalf("picked node %d, want the idle node 1", idx)
+		}
+	}
+}
+
+func TestBalancerRandomTwo(t *testing.T) {
+	lb := testBalancer(lbRandomTwo, 1, 1)
+	lb.nodes[0].Acquire()
+	for i := 0; i < 20; i++ {
+		if idx, _ := lb.Pick(nil); idx != 1 {
+			t.Fatalf("picked busy node %d", idx)
+		}
+	}
+}
+
+func TestBalancerHash(t *testing.T) {
+	lb := testBalancer(lbHash, 1, 1, 1)
+	req := &http.Request{RemoteAddr: "192.0.2.7:51234", Header: http.Header{}}
+	first, _ := lb.Pick(req)
+	req.RemoteAddr = "192.0.2.7:40000"
+	for i := 0; i < 10; i++ {
+		if idx, _ := lb.Pick(req); idx != first {
+			t.Fatalf("same client went to node %d, then %d", first, idx)
+		}
+	}
+	eject(lb.nodes[first])
+	moved, ok := lb.Pick(req)
+	if !ok || moved == first {
+		t.Fatalf("picked node %d after ejecting %d", moved, first)
+	}
+}
+
+func TestBalancerHashHeader(t *testing.T) {
+	lb := testBalancer(lbHash, 1, 1, 1)
+	lb.hashKey = "header:X-User"
+	seen := make(map[int]bool)
+	for i := 0; i < 50; i++ {
+		req := &http.Request{RemoteAddr: "192.0.2.7:51234", Header: http.Header{"X-User": {"user" + strconv.Itoa(i)}}}
+		idx, _ := lb.Pick(req)
+		seen[idx] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("50 users all went to the same node")
+	}
+}
+
+func TestBalancerSkipsUnhealthy(t *testing.T) {
+	for _, policy := range lbPolicies {
+		lb := testBalancer(policy, 1, 1, 1)
+		eject(lb.nodes[0])
+		eject(lb.nodes[2])
+		req := &http.Request{RemoteAddr: "192.0.2.7:51234", Header: http.Header{}}
+		for i := 0; i < 10; i++ {
+			if idx, ok := lb.Pick(req); !ok || idx != 1 {
+				t.Fatalf("%s: picked node %d, want 1", policy, idx)
+			}
+		}
+		eject(lb.nodes[1])
+		if _, ok := lb.Pick(req); ok {
+			t.Errorf("%s: picked a node with none healthy", policy)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type upstreamHealth struct {
+	kind         string
+	group        string
+	server       string
+	opts         *cfgHealthOpts
+	check        func() error
+	mu           sync.Mutex
+	healthy      bool
+	fails        int
+	rises        int
+	ejections    int
+	ejectedUntil time.Time
+	closing      chan bool
+	closeOnce    sync.Once
+}
+
+func (health *upstreamHealth) active() bool {
+	return health.check != nil && health.opts.Interval > 0
+}
+
+func (health *upstreamHealth) backoff() time.Duration {
+	d := health.opts.Backoff
+	for i := 1; i < health.ejections; i++ {
+		if health.opts.MaxBackoff > 0 && d >= health.opts.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+	if health.opts.MaxBackoff > 0 && d > health.opts.MaxBackoff {
+		d = health.opts.MaxBackoff
+	}
+	return d
+}
+
+func (health *upstreamHealth) Healthy() bool {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if health.healthy {
+		return true
+	}
+	// Without active checks an ejected server is given trial requests once its backoff expires.
+	return !health.active() && time.Now().After(health.ejectedUntil)
+}
+
+func (health *upstreamHealth) Success() {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	health.fails = 0
+	if health.healthy {
+		return
+	}
+	if time.Now().Before(health.ejectedUntil) {
+		return
+	}
+	health.rises++
+	if health.active() && health.rises < health.opts.Rises {
+		return
+	}
+	health.healthy = true
+	health.rises = 0
+	health.ejections = 0
+	log.Printf("Upstream healthy: name=%s server=%s", health.group, health.server)
+}
+
+func (health *upstreamHealth) Failure(err error) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	stats.Add("gosimpleweb_upstream_errors_total", "Upstream errors per server.", metricLabels("type", health.kind, "name", health.group, "server", health.server), 1)
+	health.rises = 0
+	health.fails++
+	if health.healthy {
+		if health.fails < health.opts.MaxFails {
+			return
+		}
+		health.healthy = false
+	}
+	health.ejections++
+	backoff := health.backoff()
+	health.ejectedUntil = time.Now().Add(backoff)
+	log.Printf("Upstream unhealthy: name=%s server=%s fails=%d backoff=%s err=%v", health.group, health.server, health.fails, backoff, err)
+}
+
+func (health *upstreamHealth) Report(err error) {
+	if err == nil {
+		health.Success()
+	} else {
+		health.Failure(err)
+	}
+}
+
+func (health *upstreamHealth) run() {
+	if !health.active() {
+		return
+	}
+	ticker := time.NewTicker(health.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			health.mu.Lock()
+			waiting := !health.healthy && time.Now().Before(health.ejectedUntil)
+			health.mu.Unlock()
+			if !waiting {
+				health.Report(health.check())
+			}
+		case <-health.closing:
+			return
+		}
+	}
+}
+
+func (health *upstreamHealth) Close() {
+	health.closeOnce.Do(func() {
+		close(health.closing)
+	})
+}
+
+func newUpstreamHealth(kind, group, server string, opts *cfgHealthOpts, check func() error) (health *upstreamHealth) {
+	health = &upstreamHealth{
+		kind:    kind,
+		group:   group,
+		server:  server,
+		opts:    opts,
+		check:   check,
+		healthy: true,
+		closing: make(chan bool),
+	}
+	go health.run()
+	return
+}